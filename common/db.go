@@ -0,0 +1,52 @@
+package common
+
+import (
+	"sync"
+
+	"github.com/jmoiron/sqlx"
+	_ "github.com/mattn/go-sqlite3"
+)
+
+// The db of the common utilities, e.g. the mailer's configuration and the
+// queued jobs. It's opened on first use, so modules that don't need it don't
+// require ./db to exist.
+var (
+	commonDB     *sqlx.DB
+	commonDBErr  error
+	commonDBOnce sync.Once
+)
+
+func getDB() (*sqlx.DB, error) {
+	commonDBOnce.Do(func() {
+		commonDB, commonDBErr = openDB()
+	})
+	return commonDB, commonDBErr
+}
+
+func openDB() (*sqlx.DB, error) {
+	db, err := sqlx.Open("sqlite3", "./db/common.sqlite?_journal_mode=WAL&_synchronous=NORMAL&_busy_timeout=5000&_cache_size=-2000")
+	if err != nil {
+		return nil, err
+	}
+	_, err = db.Exec("PRAGMA journal_mode = WAL")
+	if err != nil {
+		return nil, err
+	}
+	_, err = db.Exec("PRAGMA synchronous = NORMAL")
+	if err != nil {
+		return nil, err
+	}
+	_, err = db.Exec("PRAGMA busy_timeout = 5000")
+	if err != nil {
+		return nil, err
+	}
+	err = createMailerTable(db)
+	if err != nil {
+		return nil, err
+	}
+	err = createJobsTable(db)
+	if err != nil {
+		return nil, err
+	}
+	return db, nil
+}
@@ -9,12 +9,14 @@ import (
 )
 
 // Env is a globally-accessible variable that holds the environment variables
-// for the application. It is initialized in the init function. Just import it in your
-// package and use it to access the environment variables.
-var Env = Environment{}
+// for the application. It is initialized before the package variables that depend on it,
+// like CSRF. Just import it in your package and use it to access the environment variables.
+var Env = loadEnvironment()
 
-func init() {
-	Env.init()
+func loadEnvironment() Environment {
+	env := Environment{}
+	env.init()
+	return env
 }
 
 type Environment struct {
@@ -26,6 +28,38 @@ type Environment struct {
 	ENVIRONMENT string `env:"ENVIRONMENT" default:"production"` // development, production, test
 	BASE_URL    string `env:"BASE_URL" default:"http://localhost:3000"`
 
+	// Admin account created when there are no users yet, see the users module
+	ADMIN_USERNAME string `env:"ADMIN_USERNAME" default:"admin"`
+	ADMIN_PASSWORD string `env:"ADMIN_PASSWORD" default:""`
+
+	// Whether results can be viewed without logging in
+	PUBLIC_RESULTS string `env:"PUBLIC_RESULTS" default:"true"`
+
+	// Whether session & CSRF cookies are only sent over HTTPS. Set it to false
+	// when serving plain HTTP, e.g. locally.
+	SECURE_COOKIES string `env:"SECURE_COOKIES" default:"true"`
+
+	// Key secrets are encrypted with before they're stored, see crypto.go
+	SECRET_KEY string `env:"SECRET_KEY" default:""`
+
+	// Bootstraps the mailer's configuration, which is then stored in SQLite, see mailer.go
+	SMTP_URL string `env:"SMTP_URL" default:""`
+
+	// Where latency alerts are sent, comma separated. They're always logged.
+	ALERT_EMAILS       string `env:"ALERT_EMAILS" default:""`
+	ALERT_WEBHOOK_URLS string `env:"ALERT_WEBHOOK_URLS" default:""`
+
+	// Who gets a summary email after every run, comma separated
+	RUN_SUMMARY_EMAILS string `env:"RUN_SUMMARY_EMAILS" default:""`
+
+	// Bearer token Prometheus scrapes /metrics with, see metrics.go. Empty
+	// leaves the endpoint public.
+	METRICS_TOKEN string `env:"METRICS_TOKEN" default:""`
+
+	// Where traces are exported, see tracing.go. Both are off when empty.
+	OTLP_ENDPOINT string `env:"OTLP_ENDPOINT" default:""` // e.g. http://jaeger:4318
+	TRACES_FILE   string `env:"TRACES_FILE" default:""`   // a path, or "stdout"
+
 	// * Add more environment variables here
 
 	// Postgres
@@ -33,6 +67,18 @@ type Environment struct {
 	INTRA_AZ_POSTGRES_URL     string `env:"INTRA_AZ_POSTGRES_URL"`
 	INTER_AZ_POSTGRES_URL     string `env:"INTER_AZ_POSTGRES_URL"`
 	INTER_REGION_POSTGRES_URL string `env:"INTER_REGION_POSTGRES_URL"`
+
+	// Postgres clients each scenario runs with, comma separated: pq, pgx, pgxpool
+	SAME_BOX_POSTGRES_CLIENTS     string `env:"SAME_BOX_POSTGRES_CLIENTS" default:"pq"`
+	INTRA_AZ_POSTGRES_CLIENTS     string `env:"INTRA_AZ_POSTGRES_CLIENTS" default:"pq"`
+	INTER_AZ_POSTGRES_CLIENTS     string `env:"INTER_AZ_POSTGRES_CLIENTS" default:"pq"`
+	INTER_REGION_POSTGRES_CLIENTS string `env:"INTER_REGION_POSTGRES_CLIENTS" default:"pq"`
+
+	// Lets the simulations create the latency_bench schema on Postgres targets
+	ALLOW_BENCH_SCHEMA_CREATION string `env:"ALLOW_BENCH_SCHEMA_CREATION" default:"false"`
+
+	// Redis-compatible cache: a redis:// URL, "embedded" for an in-process server, or empty to skip it
+	CACHE_URL string `env:"CACHE_URL" default:""`
 }
 
 func (e *Environment) init() {
@@ -0,0 +1,83 @@
+package common
+
+import (
+	"crypto/subtle"
+	"errors"
+	"strconv"
+	"time"
+
+	"github.com/gofiber/fiber/v2"
+	"github.com/gofiber/fiber/v2/middleware/adaptor"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+)
+
+// Metrics are exposed on /metrics in the Prometheus text format, for
+// Prometheus (and Grafana through it) to scrape. The Metrics middleware
+// records the HTTP requests of the app, and modules register their own
+// metrics with prometheus.MustRegister, e.g. the latest latency results.
+//
+// Set METRICS_TOKEN to require scrapers to send it as a bearer token.
+
+var (
+	httpRequests = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "http_requests_total",
+		Help: "HTTP requests handled, by method, route and status code.",
+	}, []string{"method", "route", "status"})
+
+	httpRequestDuration = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Name:    "http_request_duration_seconds",
+		Help:    "How long HTTP requests took to handle, by method and route.",
+		Buckets: prometheus.DefBuckets,
+	}, []string{"method", "route"})
+
+	httpRequestsInFlight = prometheus.NewGauge(prometheus.GaugeOpts{
+		Name: "http_requests_in_flight",
+		Help: "HTTP requests being handled.",
+	})
+)
+
+func init() {
+	prometheus.MustRegister(httpRequests, httpRequestDuration, httpRequestsInFlight)
+}
+
+// Records every request. Use it before the routes, so it sees all of them.
+// Requests are labeled with the route they matched, e.g. /runs/:id/rerun,
+// rather than their path, so the number of series stays bounded.
+func Metrics(c *fiber.Ctx) error {
+	start := time.Now()
+	httpRequestsInFlight.Inc()
+	defer httpRequestsInFlight.Dec()
+
+	err := c.Next()
+
+	// errors are turned into responses by the error handler after this
+	// middleware returns, so their status is derived the same way
+	status := c.Response().StatusCode()
+	if err != nil {
+		status = fiber.StatusInternalServerError
+		var fiberErr *fiber.Error
+		if errors.As(err, &fiberErr) {
+			status = fiberErr.Code
+		}
+	}
+	method := c.Method()
+	route := c.Route().Path
+	httpRequests.WithLabelValues(method, route, strconv.Itoa(status)).Inc()
+	httpRequestDuration.WithLabelValues(method, route).Observe(time.Since(start).Seconds())
+	return err
+}
+
+// Adds the /metrics endpoint.
+func AddMetricsRoutes(app *fiber.App) {
+	handler := adaptor.HTTPHandler(promhttp.Handler())
+	app.Get("/metrics", func(c *fiber.Ctx) error {
+		if Env.METRICS_TOKEN != "" {
+			expected := "Bearer " + Env.METRICS_TOKEN
+			if subtle.ConstantTimeCompare([]byte(c.Get(fiber.HeaderAuthorization)), []byte(expected)) != 1 {
+				return c.Status(401).SendString("invalid metrics token")
+			}
+		}
+		return handler(c)
+	})
+}
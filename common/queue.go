@@ -0,0 +1,454 @@
+package common
+
+import (
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"sync"
+	"time"
+
+	"github.com/gofiber/fiber/v2"
+	"github.com/jmoiron/sqlx"
+)
+
+// A Queue processes jobs asynchronously, e.g. sending emails. Create one per
+// module that needs it, with its own workers, register a handler per job
+// name, start it and then add jobs as you go:
+//
+//	queue := common.NewQueue("mailer", 2)
+//	queue.Handle("send_email", common.JobOptions{Lockable: true}, sendEmailJob)
+//	err := queue.Start()
+//	...
+//	err = queue.Add("send_email", "user@example.com", email)
+//
+// Jobs are stored in SQLite with their JSON encoded payload, so they survive
+// restarts: jobs that were running when the app stopped run again on Start.
+// Handlers get the claimed job, with its payload and which attempt it is.
+//
+// A job name can be "lockable": then a job with the same name and key can't
+// be added while one is queued or running. That's useful in cases like "I
+// don't want to schedule a password reset email to the same user 3 times".
+//
+// Failed jobs are retried with an exponential backoff. Once they run out of
+// attempts they're dead: they stay in the db, listed on the jobs page (see
+// AddQueueRoutes), where they can be retried by hand.
+
+type Queue struct {
+	name     string
+	workers  int
+	wake     chan struct{}
+	mu       sync.Mutex // held while checking locks and adding jobs
+	handlers map[string]jobHandler
+}
+
+type JobOptions struct {
+	Lockable bool
+
+	// How many times a job runs before it's dead. Defaults to 5.
+	MaxAttempts int
+}
+
+type jobHandler struct {
+	run  func(job Job) error
+	opts JobOptions
+}
+
+type JobStatus string
+
+const (
+	JobQueued    JobStatus = "queued"
+	JobRunning   JobStatus = "running"
+	JobSucceeded JobStatus = "succeeded"
+	JobDead      JobStatus = "dead" // ran out of attempts
+)
+
+var JobStatuses = []JobStatus{JobQueued, JobRunning, JobSucceeded, JobDead}
+
+type Job struct {
+	ID          int       `db:"id"`
+	Queue       string    `db:"queue"`
+	Name        string    `db:"name"`
+	Key         string    `db:"key"`
+	Payload     string    `db:"payload"`
+	Status      JobStatus `db:"status"`
+	Attempts    int       `db:"attempts"` // including the running one
+	MaxAttempts int       `db:"max_attempts"`
+	LastError   string    `db:"last_error"`
+	RunAt       time.Time `db:"run_at"` // when it can run next
+	CreatedAt   time.Time `db:"created_at"`
+	UpdatedAt   time.Time `db:"updated_at"`
+}
+
+var ErrJobLocked = errors.New("a job with this name and key is already queued or running")
+
+// The queues by name, so jobs listed on the jobs page can be retried by the
+// queue that runs them.
+var (
+	queuesMu sync.Mutex
+	queues   = map[string]*Queue{}
+)
+
+const (
+	defaultJobMaxAttempts = 5
+	jobInitialBackoff     = 5 * time.Second
+	jobMaxBackoff         = time.Hour
+
+	// How often idle workers look for jobs, e.g. ones whose retry is due.
+	// Added jobs wake them up right away.
+	jobPollInterval = time.Second
+
+	// Succeeded jobs are deleted after a while, dead ones are kept.
+	jobRetention = 7 * 24 * time.Hour
+
+	// How many jobs the jobs page lists.
+	jobsListed = 100
+)
+
+func createJobsTable(db *sqlx.DB) error {
+	_, err := db.Exec(`CREATE TABLE IF NOT EXISTS jobs (
+		id INTEGER PRIMARY KEY AUTOINCREMENT,
+		queue TEXT NOT NULL,
+		name TEXT NOT NULL,
+		key TEXT NOT NULL DEFAULT '',
+		payload TEXT NOT NULL,
+		status TEXT NOT NULL,
+		attempts INTEGER NOT NULL DEFAULT 0,
+		max_attempts INTEGER NOT NULL,
+		last_error TEXT NOT NULL DEFAULT '',
+		run_at TIMESTAMP NOT NULL,
+		created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
+		updated_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP
+	)`)
+	if err != nil {
+		return err
+	}
+	_, err = db.Exec(`CREATE INDEX IF NOT EXISTS idx_jobs_queue_status ON jobs (queue, status, run_at)`)
+	return err
+}
+
+// Creates a queue. Register its handlers, then Start it. Queue names are
+// unique: the jobs are stored by queue name.
+func NewQueue(name string, workers int) *Queue {
+	q := &Queue{
+		name:     name,
+		workers:  workers,
+		wake:     make(chan struct{}, 1),
+		handlers: map[string]jobHandler{},
+	}
+	queuesMu.Lock()
+	defer queuesMu.Unlock()
+	queues[name] = q
+	return q
+}
+
+// Registers the handler of a job name. Register handlers before starting
+// the queue.
+func (q *Queue) Handle(name string, opts JobOptions, run func(job Job) error) {
+	if opts.MaxAttempts <= 0 {
+		opts.MaxAttempts = defaultJobMaxAttempts
+	}
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	q.handlers[name] = jobHandler{run: run, opts: opts}
+}
+
+// Starts the workers. Jobs that were running when the app stopped are
+// queued again, and old succeeded jobs are deleted.
+func (q *Queue) Start() error {
+	db, err := getDB()
+	if err != nil {
+		return err
+	}
+	_, err = db.Exec(`UPDATE jobs SET status = ?, updated_at = CURRENT_TIMESTAMP WHERE queue = ? AND status = ?`, JobQueued, q.name, JobRunning)
+	if err != nil {
+		return err
+	}
+	_, err = db.Exec(`DELETE FROM jobs WHERE queue = ? AND status = ? AND updated_at < ?`, q.name, JobSucceeded, time.Now().Add(-jobRetention).UTC())
+	if err != nil {
+		return err
+	}
+
+	for i := 0; i < q.workers; i++ {
+		go q.work()
+	}
+	return nil
+}
+
+// Adds a job. The key only matters for lockable jobs, e.g. the recipient of
+// an email. Jobs added before the queue is started wait for it.
+func (q *Queue) Add(name, key string, payload any) error {
+	encoded, err := json.Marshal(payload)
+	if err != nil {
+		return err
+	}
+	db, err := getDB()
+	if err != nil {
+		return err
+	}
+
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	handler, ok := q.handlers[name]
+	if !ok {
+		return fmt.Errorf("queue %s has no handler for %s jobs", q.name, name)
+	}
+	if handler.opts.Lockable {
+		err = q.checkLock(db, name, key)
+		if err != nil {
+			return err
+		}
+	}
+
+	_, err = db.Exec(`INSERT INTO jobs (queue, name, key, payload, status, max_attempts, run_at) VALUES (?, ?, ?, ?, ?, ?, ?)`,
+		q.name, name, key, string(encoded), JobQueued, handler.opts.MaxAttempts, time.Now().UTC())
+	if err != nil {
+		return err
+	}
+	q.notify()
+	return nil
+}
+
+// Returns ErrJobLocked if a job with the name and key is queued or running.
+// Call it with q.mu held, until the job is added.
+func (q *Queue) checkLock(db *sqlx.DB, name, key string) error {
+	var count int
+	err := db.Get(&count, `SELECT COUNT(*) FROM jobs WHERE queue = ? AND name = ? AND key = ? AND status IN (?, ?)`,
+		q.name, name, key, JobQueued, JobRunning)
+	if err != nil {
+		return err
+	}
+	if count > 0 {
+		return ErrJobLocked
+	}
+	return nil
+}
+
+// Wakes up an idle worker, if any.
+func (q *Queue) notify() {
+	select {
+	case q.wake <- struct{}{}:
+	default:
+	}
+}
+
+func (q *Queue) work() {
+	for {
+		job, err := q.claim()
+		if err != nil {
+			log.Printf("Queue %s: error claiming a job: %v", q.name, err)
+		}
+		if job == nil {
+			select {
+			case <-q.wake:
+			case <-time.After(jobPollInterval):
+			}
+			continue
+		}
+		q.run(*job)
+	}
+}
+
+// Marks the next due job as running and returns it, or nil if none is due.
+func (q *Queue) claim() (*Job, error) {
+	db, err := getDB()
+	if err != nil {
+		return nil, err
+	}
+	var job Job
+	err = db.Get(&job, `
+		UPDATE jobs SET status = ?, attempts = attempts + 1, updated_at = CURRENT_TIMESTAMP
+		WHERE id = (
+			SELECT id FROM jobs WHERE queue = ? AND status = ? AND run_at <= ?
+			ORDER BY run_at, id LIMIT 1
+		)
+		RETURNING *
+	`, JobRunning, q.name, JobQueued, time.Now().UTC())
+	if err == sql.ErrNoRows {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	return &job, nil
+}
+
+// Runs a claimed job and records the outcome: succeeded, queued again after
+// a backoff, or dead.
+func (q *Queue) run(job Job) {
+	q.mu.Lock()
+	handler, ok := q.handlers[job.Name]
+	q.mu.Unlock()
+
+	var err error
+	if ok {
+		err = runJob(handler, job)
+	} else {
+		err = fmt.Errorf("no handler for %s jobs", job.Name)
+	}
+
+	db, dbErr := getDB()
+	if dbErr != nil {
+		log.Printf("Queue %s: error recording job %d: %v", q.name, job.ID, dbErr)
+		return
+	}
+	if err == nil {
+		_, dbErr = db.Exec(`UPDATE jobs SET status = ?, last_error = '', updated_at = CURRENT_TIMESTAMP WHERE id = ?`, JobSucceeded, job.ID)
+	} else if job.Attempts < job.MaxAttempts {
+		log.Printf("Queue %s: %s job %d failed (attempt %d of %d): %v", q.name, job.Name, job.ID, job.Attempts, job.MaxAttempts, err)
+		_, dbErr = db.Exec(`UPDATE jobs SET status = ?, last_error = ?, run_at = ?, updated_at = CURRENT_TIMESTAMP WHERE id = ?`,
+			JobQueued, err.Error(), time.Now().Add(jobBackoff(job.Attempts)).UTC(), job.ID)
+	} else {
+		log.Printf("Queue %s: %s job %d is dead after %d attempts: %v", q.name, job.Name, job.ID, job.Attempts, err)
+		_, dbErr = db.Exec(`UPDATE jobs SET status = ?, last_error = ?, updated_at = CURRENT_TIMESTAMP WHERE id = ?`, JobDead, err.Error(), job.ID)
+	}
+	if dbErr != nil {
+		log.Printf("Queue %s: error recording job %d: %v", q.name, job.ID, dbErr)
+	}
+}
+
+// Runs the handler, turning a panic into an error so a bad job doesn't
+// take the worker down with it.
+func runJob(handler jobHandler, job Job) (err error) {
+	defer func() {
+		if recovered := recover(); recovered != nil {
+			err = fmt.Errorf("panic: %v", recovered)
+		}
+	}()
+	return handler.run(job)
+}
+
+// 5s, 10s, 20s, ... up to an hour.
+func jobBackoff(attempts int) time.Duration {
+	backoff := jobInitialBackoff
+	for i := 1; i < attempts && backoff < jobMaxBackoff; i++ {
+		backoff *= 2
+	}
+	return min(backoff, jobMaxBackoff)
+}
+
+// Returns the most recent jobs of every queue, newest first, optionally
+// only the ones with the given status.
+func ListJobs(status JobStatus) ([]Job, error) {
+	db, err := getDB()
+	if err != nil {
+		return nil, err
+	}
+	jobs := []Job{}
+	if status == "" {
+		err = db.Select(&jobs, `SELECT * FROM jobs ORDER BY id DESC LIMIT ?`, jobsListed)
+	} else {
+		err = db.Select(&jobs, `SELECT * FROM jobs WHERE status = ? ORDER BY id DESC LIMIT ?`, status, jobsListed)
+	}
+	return jobs, err
+}
+
+// Queues a dead job again, with a fresh set of attempts. Like Add, it fails
+// with ErrJobLocked if the job is lockable and another one with the same key
+// is queued or running.
+func RetryJob(id int) error {
+	db, err := getDB()
+	if err != nil {
+		return err
+	}
+	var job Job
+	err = db.Get(&job, `SELECT * FROM jobs WHERE id = ? AND status = ?`, id, JobDead)
+	if err == sql.ErrNoRows {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	queuesMu.Lock()
+	q, ok := queues[job.Queue]
+	queuesMu.Unlock()
+	if !ok {
+		return fmt.Errorf("no queue %s to retry job %d", job.Queue, id)
+	}
+
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	if q.handlers[job.Name].opts.Lockable {
+		err = q.checkLock(db, job.Name, job.Key)
+		if err != nil {
+			return err
+		}
+	}
+	_, err = db.Exec(`UPDATE jobs SET status = ?, attempts = 0, run_at = ?, updated_at = CURRENT_TIMESTAMP WHERE id = ? AND status = ?`,
+		JobQueued, time.Now().UTC(), id, JobDead)
+	if err != nil {
+		return err
+	}
+	q.notify()
+	return nil
+}
+
+// Deletes a job, unless it's running.
+func DeleteJob(id int) error {
+	db, err := getDB()
+	if err != nil {
+		return err
+	}
+	_, err = db.Exec(`DELETE FROM jobs WHERE id = ? AND status != ?`, id, JobRunning)
+	return err
+}
+
+// The classes of the status badges on the jobs page. Queued jobs that
+// already failed are retrying, they're highlighted too.
+func jobStatusClass(job Job) string {
+	switch {
+	case job.Status == JobSucceeded:
+		return "bg-green-50 text-green-700 dark:bg-green-900 dark:text-green-200"
+	case job.Status == JobDead:
+		return "bg-red-50 text-red-700 dark:bg-red-900 dark:text-red-200"
+	case job.LastError != "":
+		return "bg-yellow-50 text-yellow-700 dark:bg-yellow-900 dark:text-yellow-200"
+	}
+	return "bg-gray-50 text-gray-600 dark:bg-gray-800 dark:text-gray-300"
+}
+
+const jobsPath = "/jobs"
+
+// Adds the jobs page, listing the jobs of every queue. The guard should only
+// let admins through, e.g. users.RequireRole(users.Admin).
+func AddQueueRoutes(app *fiber.App, guard fiber.Handler) {
+	jobs := app.Group(jobsPath, guard, CSRF)
+
+	jobs.Get("/", func(c *fiber.Ctx) error {
+		status := JobStatus(c.Query("status"))
+		list, err := ListJobs(status)
+		if err != nil {
+			return c.Status(500).SendString(err.Error())
+		}
+		c.Set("Cache-Control", "no-store")
+		return RenderTempl(c, jobs_page(list, status, CSRFToken(c)))
+	})
+
+	jobs.Post("/:id/retry", func(c *fiber.Ctx) error {
+		id, err := c.ParamsInt("id")
+		if err != nil {
+			return c.Status(400).SendString(err.Error())
+		}
+		err = RetryJob(id)
+		if err == ErrJobLocked {
+			return c.Status(409).SendString(err.Error())
+		}
+		if err != nil {
+			return c.Status(500).SendString(err.Error())
+		}
+		return c.Redirect(jobsPath + "?status=" + string(JobDead))
+	})
+
+	jobs.Post("/:id/delete", func(c *fiber.Ctx) error {
+		id, err := c.ParamsInt("id")
+		if err != nil {
+			return c.Status(400).SendString(err.Error())
+		}
+		err = DeleteJob(id)
+		if err != nil {
+			return c.Status(500).SendString(err.Error())
+		}
+		return c.Redirect(jobsPath)
+	})
+}
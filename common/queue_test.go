@@ -0,0 +1,181 @@
+package common
+
+import (
+	"errors"
+	"fmt"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestJobBackoff(t *testing.T) {
+	tests := []struct {
+		attempts int
+		want     time.Duration
+	}{
+		{0, 5 * time.Second},
+		{1, 5 * time.Second},
+		{2, 10 * time.Second},
+		{3, 20 * time.Second},
+		{10, 2560 * time.Second},
+		{11, time.Hour},
+		{1000, time.Hour},
+	}
+	for _, tt := range tests {
+		if got := jobBackoff(tt.attempts); got != tt.want {
+			t.Errorf("jobBackoff(%d) = %v, want %v", tt.attempts, got, tt.want)
+		}
+	}
+}
+
+// Returns a queue with a unique name, whose jobs are deleted after the test.
+func newTestQueue(t *testing.T) *Queue {
+	t.Helper()
+	q := NewQueue(fmt.Sprintf("test-%d", time.Now().UnixNano()), 1)
+	t.Cleanup(func() {
+		db, err := getDB()
+		if err == nil {
+			db.Exec(`DELETE FROM jobs WHERE queue = ?`, q.name)
+		}
+	})
+	return q
+}
+
+// Returns the jobs of the queue, oldest first.
+func jobsOf(t *testing.T, q *Queue) []Job {
+	t.Helper()
+	db, err := getDB()
+	if err != nil {
+		t.Fatal(err)
+	}
+	jobs := []Job{}
+	err = db.Select(&jobs, `SELECT * FROM jobs WHERE queue = ? ORDER BY id`, q.name)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return jobs
+}
+
+// Waits for the queue's only job to reach the status, and returns it.
+func waitForJob(t *testing.T, q *Queue, status JobStatus, timeout time.Duration) Job {
+	t.Helper()
+	deadline := time.Now().Add(timeout)
+	for {
+		jobs := jobsOf(t, q)
+		if len(jobs) == 1 && jobs[0].Status == status {
+			return jobs[0]
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("jobs = %+v after %v, want a single %s one", jobs, timeout, status)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func TestAddLockable(t *testing.T) {
+	q := newTestQueue(t)
+	q.Handle("lockable", JobOptions{Lockable: true}, func(job Job) error { return nil })
+	q.Handle("plain", JobOptions{}, func(job Job) error { return nil })
+
+	for _, tt := range []struct {
+		name string
+		key  string
+		want error
+	}{
+		{"lockable", "a", nil},
+		{"lockable", "a", ErrJobLocked},
+		{"lockable", "b", nil},
+		{"plain", "a", nil},
+		{"plain", "a", nil},
+	} {
+		if err := q.Add(tt.name, tt.key, nil); err != tt.want {
+			t.Errorf("Add(%s, %s) = %v, want %v", tt.name, tt.key, err, tt.want)
+		}
+	}
+	if err := q.Add("unknown", "", nil); err == nil {
+		t.Errorf("Add() of a job without a handler succeeded")
+	}
+}
+
+// A retried job starts over from its first attempt, and runs right away
+// rather than when the workers next poll.
+func TestRetryJob(t *testing.T) {
+	q := newTestQueue(t)
+	var mu sync.Mutex
+	attempts := []int{}
+	failing := true
+	q.Handle("job", JobOptions{MaxAttempts: 1}, func(job Job) error {
+		mu.Lock()
+		defer mu.Unlock()
+		attempts = append(attempts, job.Attempts)
+		if failing {
+			return errors.New("failing")
+		}
+		return nil
+	})
+	err := q.Add("job", "", nil)
+	if err == nil {
+		err = q.Start()
+	}
+	if err != nil {
+		t.Fatal(err)
+	}
+	dead := waitForJob(t, q, JobDead, 5*time.Second)
+	if dead.LastError != "failing" {
+		t.Errorf("last error = %q, want failing", dead.LastError)
+	}
+
+	mu.Lock()
+	failing = false
+	mu.Unlock()
+	err = RetryJob(dead.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	waitForJob(t, q, JobSucceeded, jobPollInterval/2)
+
+	mu.Lock()
+	defer mu.Unlock()
+	if fmt.Sprint(attempts) != "[1 1]" {
+		t.Errorf("attempts = %v, want [1 1]", attempts)
+	}
+}
+
+func TestRetryJobLocked(t *testing.T) {
+	q := newTestQueue(t)
+	q.Handle("lockable", JobOptions{Lockable: true}, func(job Job) error { return nil })
+	db, err := getDB()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// a dead job, then another one with the same key, which is queued
+	err = q.Add("lockable", "a", nil)
+	if err == nil {
+		_, err = db.Exec(`UPDATE jobs SET status = ? WHERE queue = ?`, JobDead, q.name)
+	}
+	if err == nil {
+		err = q.Add("lockable", "a", nil)
+	}
+	if err != nil {
+		t.Fatal(err)
+	}
+	jobs := jobsOf(t, q)
+	if err := RetryJob(jobs[0].ID); err != ErrJobLocked {
+		t.Errorf("RetryJob() while another job is queued = %v, want ErrJobLocked", err)
+	}
+	if jobs := jobsOf(t, q); jobs[0].Status != JobDead {
+		t.Errorf("locked job is now %s, want it dead", jobs[0].Status)
+	}
+
+	_, err = db.Exec(`DELETE FROM jobs WHERE id = ?`, jobs[1].ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := RetryJob(jobs[0].ID); err != nil {
+		t.Errorf("RetryJob() = %v, want the job queued", err)
+	}
+	if jobs := jobsOf(t, q); jobs[0].Status != JobQueued || jobs[0].Attempts != 0 {
+		t.Errorf("retried job = %+v, want it queued with no attempts", jobs[0])
+	}
+}
@@ -0,0 +1,101 @@
+package common
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net/url"
+	"os"
+	"strings"
+
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/exporters/otlp/otlptrace/otlptracehttp"
+	"go.opentelemetry.io/otel/exporters/stdout/stdouttrace"
+	"go.opentelemetry.io/otel/sdk/resource"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	semconv "go.opentelemetry.io/otel/semconv/v1.21.0"
+)
+
+// Traces are exported with OpenTelemetry, to an OTLP endpoint (e.g. Jaeger
+// or an OpenTelemetry collector) when OTLP_ENDPOINT is set, and/or written
+// as JSON to TRACES_FILE ("stdout" for the standard output) to inspect them
+// offline. When neither is set, tracing is off and spans cost next to nothing.
+//
+// Modules get a tracer with otel.Tracer and start spans from it, they're
+// exported through the provider set up by StartTracing.
+
+// Spans waiting to be exported. They're dropped when the exporter can't keep
+// up, rather than slowing down what's being traced.
+const tracingQueueSize = 1 << 15
+
+// Sets up the global tracer provider. Call the returned function before
+// exiting, it flushes the spans that haven't been exported yet.
+func StartTracing(serviceName string) (func(context.Context) error, error) {
+	noop := func(context.Context) error { return nil }
+	if Env.OTLP_ENDPOINT == "" && Env.TRACES_FILE == "" {
+		return noop, nil
+	}
+
+	opts := []sdktrace.TracerProviderOption{
+		sdktrace.WithResource(resource.NewWithAttributes(semconv.SchemaURL, semconv.ServiceName(serviceName))),
+	}
+	var closers []io.Closer
+
+	if Env.OTLP_ENDPOINT != "" {
+		exporter, err := newOTLPExporter(Env.OTLP_ENDPOINT)
+		if err != nil {
+			return noop, err
+		}
+		opts = append(opts, sdktrace.WithBatcher(exporter, sdktrace.WithMaxQueueSize(tracingQueueSize)))
+	}
+
+	if Env.TRACES_FILE != "" {
+		var w io.Writer = os.Stdout
+		if Env.TRACES_FILE != "stdout" {
+			file, err := os.OpenFile(Env.TRACES_FILE, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0o644)
+			if err != nil {
+				return noop, err
+			}
+			w = file
+			closers = append(closers, file)
+		}
+		exporter, err := stdouttrace.New(stdouttrace.WithWriter(w))
+		if err != nil {
+			return noop, err
+		}
+		opts = append(opts, sdktrace.WithBatcher(exporter, sdktrace.WithMaxQueueSize(tracingQueueSize)))
+	}
+
+	provider := sdktrace.NewTracerProvider(opts...)
+	otel.SetTracerProvider(provider)
+	return func(ctx context.Context) error {
+		err := provider.Shutdown(ctx)
+		for _, closer := range closers {
+			err = errors.Join(err, closer.Close())
+		}
+		return err
+	}, nil
+}
+
+// Creates an OTLP over HTTP exporter from an endpoint URL like
+// http://jaeger:4318. Traces are posted to /v1/traces unless the URL has
+// another path.
+func newOTLPExporter(endpoint string) (sdktrace.SpanExporter, error) {
+	u, err := url.Parse(endpoint)
+	if err != nil {
+		return nil, err
+	}
+	if u.Scheme != "http" && u.Scheme != "https" || u.Host == "" {
+		return nil, fmt.Errorf("invalid OTLP endpoint %q, expected a URL like http://localhost:4318", endpoint)
+	}
+
+	opts := []otlptracehttp.Option{otlptracehttp.WithEndpoint(u.Host)}
+	if u.Scheme == "http" {
+		opts = append(opts, otlptracehttp.WithInsecure())
+	}
+	if path := strings.TrimSuffix(u.Path, "/"); path != "" {
+		opts = append(opts, otlptracehttp.WithURLPath(path))
+	}
+	return otlptracehttp.New(context.Background(), opts...)
+}
@@ -0,0 +1,246 @@
+package latency_simulations
+
+import (
+	"fmt"
+	"log"
+	"time"
+
+	"github.com/jmoiron/sqlx"
+	"github.com/montanaflynn/stats"
+)
+
+// Latency logs only hold the latest run, so every run also appends the median
+// and p95 of each label to latency_history, with a fingerprint of what it ran
+// with, see historyFingerprint. After a run, each label is compared to its
+// recent history with the same fingerprint, so changing e.g. the number of
+// products doesn't raise alerts: when the median or p95 jumps well beyond
+// the rolling median, by several MADs (median absolute deviations) and by a
+// meaningful relative amount, an alert is recorded and sent through the
+// configured notifiers, see notifiers.go.
+//
+// The median & MAD are used rather than the mean & standard deviation so a
+// single past outlier doesn't hide the next one.
+
+const (
+	// How many previous runs of a label the baseline is computed from,
+	// and how many are needed before alerting at all.
+	anomalyWindow     = 20
+	anomalyMinHistory = 5
+
+	// How many scaled MADs above the rolling median a value must be.
+	anomalyThreshold = 5.0
+
+	// How much above the rolling median a value must also be, so labels
+	// with a tiny spread don't alert on insignificant jumps.
+	anomalyMinIncrease = 0.2 // 20%
+
+	// Scales the MAD to be comparable to a standard deviation for normally
+	// distributed values.
+	madScale = 1.4826
+
+	// How many recent alerts the home page shows.
+	alertsListed = 20
+)
+
+type Alert struct {
+	ID     int    `db:"id" json:"id"`
+	RunID  int64  `db:"run_id" json:"run_id"`
+	Label  string `db:"label" json:"label"`
+	Metric string `db:"metric" json:"metric"` // "median" or "p95"
+
+	// In nanoseconds, like LatencyStats.
+	Value    float64 `db:"value" json:"value"`
+	Baseline float64 `db:"baseline" json:"baseline"` // rolling median
+	MAD      float64 `db:"mad" json:"mad"`
+
+	// How many scaled MADs the value is above the baseline.
+	Score float64 `db:"score" json:"score"`
+
+	CreatedAt time.Time `db:"created_at" json:"created_at"`
+}
+
+// e.g. "SameBox/pq Read2: p95 12.30 ms is 3.1x its rolling median of 4.00 ms (8.2 MADs)"
+func (a Alert) String() string {
+	// a zero baseline has no ratio
+	ratio := "above"
+	if a.Baseline > 0 {
+		ratio = fmt.Sprintf("%.1fx", a.Value/a.Baseline)
+	}
+	return fmt.Sprintf("%s: %s %.2f ms is %s its rolling median of %.2f ms (%.1f MADs)",
+		a.Label, a.Metric, a.Value/float64(time.Millisecond), ratio, a.Baseline/float64(time.Millisecond), a.Score)
+}
+
+func createAnomaliesTables(db *sqlx.DB) error {
+	_, err := db.Exec(`CREATE TABLE IF NOT EXISTS latency_history (
+			id INTEGER PRIMARY KEY AUTOINCREMENT,
+			run_id INTEGER NOT NULL REFERENCES simulation_runs (id),
+			label TEXT NOT NULL,
+			fingerprint TEXT NOT NULL DEFAULT '',
+			median_latency REAL NOT NULL,
+			p95_latency REAL NOT NULL,
+			created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP
+		)`)
+	if err != nil {
+		return err
+	}
+	// older history has no fingerprint, so it's never compared to new runs
+	err = addMissingColumn(db, "latency_history", "fingerprint", `TEXT NOT NULL DEFAULT ''`)
+	if err != nil {
+		return err
+	}
+	_, err = db.Exec(`CREATE INDEX IF NOT EXISTS idx_latency_history_label ON latency_history (label, run_id)`)
+	if err != nil {
+		return err
+	}
+
+	_, err = db.Exec(`CREATE TABLE IF NOT EXISTS latency_alerts (
+			id INTEGER PRIMARY KEY AUTOINCREMENT,
+			run_id INTEGER NOT NULL REFERENCES simulation_runs (id),
+			label TEXT NOT NULL,
+			metric TEXT NOT NULL,
+			value REAL NOT NULL,
+			baseline REAL NOT NULL,
+			mad REAL NOT NULL,
+			score REAL NOT NULL,
+			created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP
+		)`)
+	return err
+}
+
+// Describes what a workload's latencies depend on besides the network: the
+// dataset (see fixtureFingerprint), the workload's key distribution, the
+// number of queries and the Postgres client, if any.
+func historyFingerprint(opts SimulationOptions, client PostgresClient, workload WorkloadResult) string {
+	keys := string(workload.KeyDistribution)
+	switch workload.KeyDistribution {
+	case Zipfian, Latest:
+		keys += fmt.Sprintf("(%g)", opts.ZipfianSkew)
+	case Hotspot:
+		keys += fmt.Sprintf("(%d/%d)", opts.HotspotOps, opts.HotspotKeys)
+	}
+	return fmt.Sprintf("%s/keys=%s/queries=%d/client=%s", fixtureFingerprint(opts), keys, opts.Queries, client)
+}
+
+func recordHistory(tx *sqlx.Tx, runID int64, label string, fingerprint string, latency LatencyStats) error {
+	_, err := tx.Exec(`INSERT INTO latency_history (run_id, label, fingerprint, median_latency, p95_latency) VALUES (?, ?, ?, ?, ?)`,
+		runID, label, fingerprint, latency.MedianLatency, latency.P95Latency)
+	return err
+}
+
+type historyPoint struct {
+	Label         string  `db:"label"`
+	Fingerprint   string  `db:"fingerprint"`
+	MedianLatency float64 `db:"median_latency"`
+	P95Latency    float64 `db:"p95_latency"`
+}
+
+// Compares every label of the run to its history, and records & returns
+// the alerts.
+func detectAnomalies(runID int64) ([]Alert, error) {
+	points := []historyPoint{}
+	err := db.Select(&points, `SELECT label, fingerprint, median_latency, p95_latency FROM latency_history WHERE run_id = ?`, runID)
+	if err != nil {
+		return nil, err
+	}
+
+	alerts := []Alert{}
+	for _, point := range points {
+		history := []historyPoint{}
+		err = db.Select(&history, `
+			SELECT label, fingerprint, median_latency, p95_latency FROM latency_history
+			WHERE label = ? AND fingerprint = ? AND run_id < ? ORDER BY run_id DESC LIMIT ?
+		`, point.Label, point.Fingerprint, runID, anomalyWindow)
+		if err != nil {
+			return nil, err
+		}
+		if len(history) < anomalyMinHistory {
+			continue
+		}
+
+		medians := make([]float64, len(history))
+		p95s := make([]float64, len(history))
+		for i, h := range history {
+			medians[i] = h.MedianLatency
+			p95s[i] = h.P95Latency
+		}
+		for _, metric := range []struct {
+			name    string
+			value   float64
+			history []float64
+		}{
+			{"median", point.MedianLatency, medians},
+			{"p95", point.P95Latency, p95s},
+		} {
+			alert, ok, err := checkAnomaly(metric.value, metric.history)
+			if err != nil {
+				return nil, err
+			}
+			if ok {
+				alert.RunID = runID
+				alert.Label = point.Label
+				alert.Metric = metric.name
+				alerts = append(alerts, alert)
+			}
+		}
+	}
+
+	for i := range alerts {
+		result, err := db.NamedExec(`
+			INSERT INTO latency_alerts (run_id, label, metric, value, baseline, mad, score)
+			VALUES (:run_id, :label, :metric, :value, :baseline, :mad, :score)
+		`, alerts[i])
+		if err != nil {
+			return nil, err
+		}
+		id, err := result.LastInsertId()
+		if err != nil {
+			return nil, err
+		}
+		alerts[i].ID = int(id)
+		alerts[i].CreatedAt = time.Now()
+	}
+	return alerts, nil
+}
+
+// Checks whether the value jumped well beyond its history.
+func checkAnomaly(value float64, history []float64) (Alert, bool, error) {
+	baseline, err := stats.Median(history)
+	if err != nil {
+		return Alert{}, false, err
+	}
+	mad, err := stats.MedianAbsoluteDeviationPopulation(history)
+	if err != nil {
+		return Alert{}, false, err
+	}
+
+	// a perfectly stable history would make any change infinitely many
+	// MADs away, so the spread is at least 1% of the baseline
+	spread := max(madScale*mad, baseline*0.01)
+	if spread == 0 {
+		return Alert{}, false, nil
+	}
+	score := (value - baseline) / spread
+	ok := score >= anomalyThreshold && value >= baseline*(1+anomalyMinIncrease)
+	return Alert{Value: value, Baseline: baseline, MAD: mad, Score: score}, ok, nil
+}
+
+// Detects the anomalies of a run and notifies them in the background.
+// Errors are logged, they don't fail the run.
+func alertOnAnomalies(runID int64) {
+	alerts, err := detectAnomalies(runID)
+	if err != nil {
+		log.Printf("Error detecting anomalies of run %d: %v", runID, err)
+		return
+	}
+	if len(alerts) == 0 {
+		return
+	}
+	go notify(alerts)
+}
+
+// Returns the most recent alerts, newest first.
+func listAlerts() ([]Alert, error) {
+	alerts := []Alert{}
+	err := db.Select(&alerts, `SELECT * FROM latency_alerts ORDER BY id DESC LIMIT ?`, alertsListed)
+	return alerts, err
+}
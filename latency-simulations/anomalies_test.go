@@ -0,0 +1,86 @@
+package latency_simulations
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestCheckAnomaly(t *testing.T) {
+	stable := []float64{10, 10, 10, 10, 10}
+	noisy := []float64{10, 12, 8, 11, 9} // median 10, MAD 1
+	tests := []struct {
+		name      string
+		value     float64
+		history   []float64
+		wantAlert bool
+		wantErr   bool
+	}{
+		{"unchanged", 10, stable, false, false},
+		{"jump over a stable history", 13, stable, true, false},
+		{"many MADs but under the min increase", 11.9, stable, false, false},
+		{"drop", 5, stable, false, false},
+		{"within the noise", 15, noisy, false, false},
+		{"beyond the noise", 20, noisy, true, false},
+		{"all zero history", 1, []float64{0, 0, 0}, false, false},
+		{"no history", 1, nil, false, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			alert, ok, err := checkAnomaly(tt.value, tt.history)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("checkAnomaly() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if ok != tt.wantAlert {
+				t.Errorf("checkAnomaly() alerted %v with score %.2f, want %v", ok, alert.Score, tt.wantAlert)
+			}
+			if ok && (alert.Value != tt.value || alert.Baseline == 0) {
+				t.Errorf("checkAnomaly() alert = %+v", alert)
+			}
+		})
+	}
+}
+
+func TestHistoryFingerprint(t *testing.T) {
+	opts := newSimulationOptions()
+	opts.setDefaults()
+	opts.Seed = 1
+	read2 := WorkloadResult{Name: "Read2", KeyDistribution: Zipfian}
+	base := historyFingerprint(opts, LibPQ, read2)
+
+	changed := []string{}
+	queries := opts
+	queries.Queries++
+	changed = append(changed, historyFingerprint(queries, LibPQ, read2))
+	skew := opts
+	skew.ZipfianSkew++
+	changed = append(changed, historyFingerprint(skew, LibPQ, read2))
+	changed = append(changed, historyFingerprint(opts, PgxPool, read2))
+	changed = append(changed, historyFingerprint(opts, LibPQ, WorkloadResult{Name: "Read2", KeyDistribution: Uniform}))
+	products := opts
+	products.Products++
+	changed = append(changed, historyFingerprint(products, LibPQ, read2))
+	for i, fingerprint := range changed {
+		if fingerprint == base {
+			t.Errorf("change %d kept the fingerprint %q", i, base)
+		}
+	}
+
+	// the skew only matters to the distributions using it
+	uniform := WorkloadResult{Name: "Read1"}
+	if historyFingerprint(opts, LibPQ, uniform) != historyFingerprint(skew, LibPQ, uniform) {
+		t.Errorf("the skew changed the fingerprint of an unkeyed workload")
+	}
+}
+
+func TestAlertString(t *testing.T) {
+	alert := Alert{Label: "SameBox/pq Read2", Metric: "p95", Value: 12.3e6, Baseline: 4e6, Score: 8.2}
+	want := "SameBox/pq Read2: p95 12.30 ms is 3.1x its rolling median of 4.00 ms (8.2 MADs)"
+	if got := alert.String(); got != want {
+		t.Errorf("String() = %q, want %q", got, want)
+	}
+
+	alert.Baseline = 0
+	if got := alert.String(); strings.Contains(got, "Inf") || strings.Contains(got, "NaN") {
+		t.Errorf("String() with a zero baseline = %q", got)
+	}
+}
@@ -0,0 +1,164 @@
+package latency_simulations
+
+import (
+	"fmt"
+	"go-on-rails/common"
+	"net/url"
+	"strings"
+
+	"github.com/jmoiron/sqlx"
+	"github.com/lib/pq"
+)
+
+// Postgres targets may be shared databases, e.g. a staging db, so the
+// benchmark never touches anything outside its own schema. Connections set
+// their search_path to it, so the unqualified table names of the workloads
+// resolve there. The schema is only created when ALLOW_BENCH_SCHEMA_CREATION
+// is set, and a run is refused if the schema holds anything the tool didn't
+// create.
+
+const benchSchema = "latency_bench"
+
+// Tables, indexes & sequences the benchmark creates in its schema.
+var benchObjects = map[string]bool{
+	"products":                       true,
+	"products_pkey":                  true,
+	"products_id_seq":                true,
+	"idx_products_name":              true,
+	"product_reviews":                true,
+	"product_reviews_pkey":           true,
+	"product_reviews_id_seq":         true,
+	"idx_product_reviews_product_id": true,
+	"latency_fixtures":               true,
+}
+
+// Returns the DSN with its search_path set to the benchmark schema. Both
+// lib/pq and pgx send unknown DSN parameters as run-time parameters. A
+// search_path already in the DSN is replaced, but one set through the
+// options parameter (-c search_path=...) would win over ours, so such DSNs
+// are refused.
+func benchDSN(dsn string) (string, error) {
+	if strings.HasPrefix(dsn, "postgres://") || strings.HasPrefix(dsn, "postgresql://") {
+		u, err := url.Parse(dsn)
+		if err != nil {
+			return "", err
+		}
+		query := u.Query()
+		if strings.Contains(query.Get("options"), "search_path") {
+			return "", errSearchPathOption
+		}
+		query.Set("search_path", benchSchema)
+		u.RawQuery = query.Encode()
+		return u.String(), nil
+	}
+
+	fields := []string{}
+	for _, pair := range splitKeyValueDSN(dsn) {
+		key, value, _ := strings.Cut(pair, "=")
+		if key == "options" && strings.Contains(unquoteDSNValue(value), "search_path") {
+			return "", errSearchPathOption
+		}
+		if key != "search_path" {
+			fields = append(fields, pair)
+		}
+	}
+	return strings.Join(fields, " ") + " search_path=" + benchSchema, nil
+}
+
+// Splits a key/value DSN into its key=value pairs. Values may be quoted with
+// single quotes & contain spaces, e.g. options='-c statement_timeout=0'.
+func splitKeyValueDSN(dsn string) []string {
+	pairs := []string{}
+	var pair strings.Builder
+	quoted, escaped := false, false
+	for _, r := range dsn {
+		switch {
+		case escaped:
+			escaped = false
+		case r == '\\':
+			escaped = true
+		case r == '\'':
+			quoted = !quoted
+		case !quoted && (r == ' ' || r == '\t' || r == '\n'):
+			if pair.Len() > 0 {
+				pairs = append(pairs, pair.String())
+				pair.Reset()
+			}
+			continue
+		}
+		pair.WriteRune(r)
+	}
+	if pair.Len() > 0 {
+		pairs = append(pairs, pair.String())
+	}
+	return pairs
+}
+
+// Returns the value of a key/value DSN pair without its quotes & escapes,
+// e.g. 'it\'s' is it's.
+func unquoteDSNValue(value string) string {
+	if len(value) >= 2 && value[0] == '\'' && value[len(value)-1] == '\'' {
+		value = value[1 : len(value)-1]
+	}
+	var unquoted strings.Builder
+	escaped := false
+	for _, r := range value {
+		if r == '\\' && !escaped {
+			escaped = true
+			continue
+		}
+		escaped = false
+		unquoted.WriteRune(r)
+	}
+	return unquoted.String()
+}
+
+var errSearchPathOption = fmt.Errorf("the DSN sets search_path in its options, which would override schema %s; remove it", benchSchema)
+
+// An object in the benchmark schema, and whether the connected role owns it.
+type benchObject struct {
+	Name  string `db:"relname"`
+	Owned bool   `db:"owned"`
+}
+
+// Makes sure the benchmark schema exists and only holds the benchmark's own
+// objects, creating it if that's allowed. A schema or object owned by another
+// role wasn't created by the simulations, even if its name matches.
+func guardBenchSchema(db *sqlx.DB) error {
+	var owners []bool
+	err := db.Select(&owners, `SELECT pg_get_userbyid(nspowner) = current_user FROM pg_namespace WHERE nspname = $1`, benchSchema)
+	if err != nil {
+		return err
+	}
+
+	if len(owners) == 0 {
+		if common.Env.ALLOW_BENCH_SCHEMA_CREATION != "true" {
+			return fmt.Errorf("schema %s doesn't exist; set ALLOW_BENCH_SCHEMA_CREATION=true to let the simulations create it", benchSchema)
+		}
+		_, err = db.Exec(`CREATE SCHEMA ` + pq.QuoteIdentifier(benchSchema))
+		return err
+	}
+	if !owners[0] {
+		return fmt.Errorf("schema %s is owned by another role, so it wasn't created by the simulations; refusing to run", benchSchema)
+	}
+
+	var objects []benchObject
+	err = db.Select(&objects, `
+		SELECT c.relname, pg_get_userbyid(c.relowner) = current_user AS owned FROM pg_class c
+		JOIN pg_namespace n ON n.oid = c.relnamespace
+		WHERE n.nspname = $1`, benchSchema)
+	if err != nil {
+		return err
+	}
+	return checkBenchObjects(objects)
+}
+
+// Refuses objects of the benchmark schema the simulations didn't create.
+func checkBenchObjects(objects []benchObject) error {
+	for _, object := range objects {
+		if !benchObjects[object.Name] || !object.Owned {
+			return fmt.Errorf("schema %s contains %s, which wasn't created by the simulations; refusing to run", benchSchema, object.Name)
+		}
+	}
+	return nil
+}
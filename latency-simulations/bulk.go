@@ -0,0 +1,126 @@
+package latency_simulations
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/jackc/pgx/v5"
+	"go.opentelemetry.io/otel/attribute"
+)
+
+// Bulk workloads insert a batch of products per operation, in a few different
+// ways. Each one reports the latency per batch and the rows/sec it achieved.
+
+// Batch sizes every bulk workload runs with.
+var bulkBatchSizes = []int{10, 100, 1_000}
+
+// Batches measured per workload & batch size. Much lower than the Queries option,
+// since inserting rows one by one over inter-region links is slow, but no
+// lower than 10, the fewest latencies the P10 can be computed from.
+const bulkBatchCount = 10
+
+func bulkWorkloads() []workload {
+	result := []workload{}
+	for _, size := range bulkBatchSizes {
+		result = append(result,
+			workload{name: fmt.Sprintf("BulkRowByRow%d", size), run: bulkRowByRow(size), iterations: bulkBatchCount, rows: size},
+			workload{name: fmt.Sprintf("BulkPrepared%d", size), run: bulkPrepared(size), iterations: bulkBatchCount, rows: size},
+			workload{name: fmt.Sprintf("BulkValues%d", size), run: bulkValues(size), iterations: bulkBatchCount, rows: size},
+		)
+	}
+	return result
+}
+
+// COPY goes through pgxpool no matter the scenario's client, so it's
+// measured once per scenario, see runWorkloads.
+func copyWorkloads(t *target) []workload {
+	if t.pool == nil {
+		return []workload{}
+	}
+
+	result := []workload{}
+	for _, size := range bulkBatchSizes {
+		result = append(result, workload{name: fmt.Sprintf("BulkCopy%d", size), run: bulkCopy(size), iterations: bulkBatchCount, rows: size})
+	}
+	return result
+}
+
+// Inserts the batch one statement at a time, inside a transaction.
+func bulkRowByRow(size int) func(t *target, i int) error {
+	return func(t *target, i int) error {
+		tx, err := t.db.Beginx()
+		if err != nil {
+			return err
+		}
+		defer tx.Rollback()
+
+		query := tx.Rebind(write1Query)
+		for r := 0; r < size; r++ {
+			ctx, span := t.startQuery(query)
+			_, err = tx.ExecContext(ctx, query, fmt.Sprintf("bulk%d", r), t.rng.Float64()*100)
+			endSpan(span, err)
+			if err != nil {
+				return err
+			}
+		}
+		return tx.Commit()
+	}
+}
+
+// Prepares the insert once and executes it for every row, inside a transaction.
+func bulkPrepared(size int) func(t *target, i int) error {
+	return func(t *target, i int) error {
+		tx, err := t.db.Beginx()
+		if err != nil {
+			return err
+		}
+		defer tx.Rollback()
+
+		query := tx.Rebind(write1Query)
+		stmt, err := tx.Preparex(query)
+		if err != nil {
+			return err
+		}
+		defer stmt.Close()
+
+		for r := 0; r < size; r++ {
+			ctx, span := t.startQuery(query)
+			_, err = stmt.ExecContext(ctx, fmt.Sprintf("bulk%d", r), t.rng.Float64()*100)
+			endSpan(span, err)
+			if err != nil {
+				return err
+			}
+		}
+		return tx.Commit()
+	}
+}
+
+// Inserts the whole batch with a single multi-row `INSERT ... VALUES (...), (...)`.
+func bulkValues(size int) func(t *target, i int) error {
+	query := `INSERT INTO products (name, price) VALUES ` + strings.TrimSuffix(strings.Repeat("(?, ?), ", size), ", ")
+	return func(t *target, i int) error {
+		args := make([]any, 0, size*2)
+		for r := 0; r < size; r++ {
+			args = append(args, fmt.Sprintf("bulk%d", r), t.rng.Float64()*100)
+		}
+		rebound := t.db.Rebind(query)
+		ctx, span := t.startQuery(rebound)
+		_, err := t.db.ExecContext(ctx, rebound, args...)
+		endSpan(span, err)
+		return err
+	}
+}
+
+// Streams the batch with the Postgres COPY protocol, through pgx's CopyFrom.
+func bulkCopy(size int) func(t *target, i int) error {
+	return func(t *target, i int) error {
+		rows := make([][]any, size)
+		for r := 0; r < size; r++ {
+			rows[r] = []any{fmt.Sprintf("bulk%d", r), t.rng.Float64() * 100}
+		}
+		ctx, span := t.startQuery(`COPY products (name, price) FROM STDIN`, attribute.Int("db.rows", size))
+		_, err := t.pool.CopyFrom(ctx, pgx.Identifier{"products"}, []string{"name", "price"}, pgx.CopyFromRows(rows))
+		endSpan(span, err)
+		return err
+	}
+}
@@ -0,0 +1,175 @@
+package latency_simulations
+
+import (
+	"context"
+	"fmt"
+	"go-on-rails/common"
+	"time"
+
+	"github.com/alicebob/miniredis/v2"
+	"github.com/redis/go-redis/v9"
+)
+
+// The cache scenario measures a Redis-compatible server (Redis, Valkey, ...)
+// configured with CACHE_URL. Set it to "embedded" to run an in-process
+// miniredis instead, which is handy for trying things out and for tests.
+//
+// When a cache is configured, every Postgres scenario also runs a cache-aside
+// workload: reads go to the cache first and fall through to Postgres on a miss.
+
+const (
+	embeddedCacheURL = "embedded"
+
+	defaultCacheHitRatio = 80 // percent
+
+	// Keys fetched by each MGET.
+	cacheMGetSize = 10
+
+	// How long values written by the workloads live. The warmed up product
+	// keys don't expire, so hits stay hits for the whole run.
+	cacheTTL = time.Minute
+)
+
+// Opens the configured cache and warms it up with a key per product.
+// Returns a nil client when no cache is configured. The returned
+// function must be called to close the cache.
+func openCache(opts SimulationOptions) (*redis.Client, func(), error) {
+	url := common.Env.CACHE_URL
+	if url == "" {
+		return nil, func() {}, nil
+	}
+
+	var embedded *miniredis.Miniredis
+	if url == embeddedCacheURL {
+		var err error
+		embedded, err = miniredis.Run()
+		if err != nil {
+			return nil, func() {}, err
+		}
+		url = "redis://" + embedded.Addr()
+	}
+	closeCache := func() {
+		if embedded != nil {
+			embedded.Close()
+		}
+	}
+
+	cacheOpts, err := redis.ParseURL(url)
+	if err != nil {
+		closeCache()
+		return nil, func() {}, err
+	}
+	cache := redis.NewClient(cacheOpts)
+	closeAll := func() {
+		cache.Close()
+		closeCache()
+	}
+
+	err = warmCache(cache, opts)
+	if err != nil {
+		closeAll()
+		return nil, func() {}, err
+	}
+	return cache, closeAll, nil
+}
+
+func productCacheKey(name string) string {
+	return "latency:product:" + name
+}
+
+// Stores a value for every seeded product name, in one pipeline.
+func warmCache(cache *redis.Client, opts SimulationOptions) error {
+	ctx := context.Background()
+	r := newRand(opts.Seed, "cache")
+	pipe := cache.Pipeline()
+	for n := 0; n < opts.Products; n++ {
+		name := fmt.Sprintf("product%d", n)
+		pipe.Set(ctx, productCacheKey(name), common.Jsonify(product{ID: n + 1, Name: name, Price: r.Float64() * 100}), 0)
+	}
+	_, err := pipe.Exec(ctx)
+	return err
+}
+
+// Runs the cache scenario: a TCP connect baseline and the cache workloads.
+func simulateCache(ctx context.Context, cache *redis.Client, opts SimulationOptions) (Simulation, error) {
+	tcpConnect, err := measureTCPConnect(ctx, cache.Options().Addr, opts.Queries)
+	if err != nil {
+		return Simulation{}, err
+	}
+
+	t := &target{cache: cache, products: opts.Products, ctx: ctx}
+	results, err := measureWorkloads(t, cacheWorkloads, "", opts)
+	return Simulation{TCPConnect: tcpConnect, Workloads: results}, err
+}
+
+var cacheWorkloads = []workload{
+	{name: "Ping", run: cachePing},
+	{name: "Get", run: cacheGet, keyed: true},
+	{name: "Set", run: cacheSet},
+	{name: fmt.Sprintf("MGet%d", cacheMGetSize), run: cacheMGet, queries: cacheMGetSize, keyed: true},
+}
+
+func cachePing(t *target, i int) error {
+	return t.cache.Ping(context.Background()).Err()
+}
+
+// Gets a warmed up product.
+func cacheGet(t *target, i int) error {
+	return t.cache.Get(context.Background(), productCacheKey(t.randomProductName())).Err()
+}
+
+func cacheSet(t *target, i int) error {
+	name := fmt.Sprintf("product%d", i)
+	return t.cache.Set(context.Background(), "latency:set:"+name, common.Jsonify(product{Name: name, Price: t.rng.Float64() * 100}), cacheTTL).Err()
+}
+
+// Gets a few warmed up products at once.
+func cacheMGet(t *target, i int) error {
+	keys := make([]string, cacheMGetSize)
+	for k := range keys {
+		keys[k] = productCacheKey(t.randomProductName())
+	}
+	return t.cache.MGet(context.Background(), keys...).Err()
+}
+
+// Returns the cache-aside workload for a database target, if it has a cache.
+func cacheAsideWorkloads(t *target, opts SimulationOptions) []workload {
+	if t.cache == nil {
+		return []workload{}
+	}
+	return []workload{
+		{name: fmt.Sprintf("CacheAside%d", opts.CacheHitRatio), run: cacheAside(opts.CacheHitRatio), keyed: true},
+	}
+}
+
+// Reads a random product through the cache, like Read2 behind a cache.
+// The hit ratio (in percent) is controlled by picking either a warmed up
+// key or one that can't be cached yet. On a miss the product is read from
+// the database and written to the cache.
+func cacheAside(hitRatio int) func(t *target, i int) error {
+	return func(t *target, i int) error {
+		ctx := context.Background()
+		name := t.randomProductName()
+		key := productCacheKey(name)
+		if t.rng.Intn(100) >= hitRatio {
+			// the cache outlives runs, so misses need keys no run used before
+			key = fmt.Sprintf("latency:miss:%d:%d:%s", time.Now().UnixNano(), i, name)
+		}
+
+		err := t.cache.Get(ctx, key).Err()
+		if err == nil {
+			t.cacheHits++
+			return nil
+		}
+		if err != redis.Nil {
+			return err
+		}
+		t.cacheMisses++
+
+		p, err := queryOne[product](t, read2Query, name)
+		if err != nil {
+			return err
+		}
+		return t.cache.Set(ctx, key, common.Jsonify(p), cacheTTL).Err()
+	}
+}
@@ -0,0 +1,83 @@
+package latency_simulations
+
+import (
+	"context"
+	"fmt"
+	"go-on-rails/common"
+	"strings"
+
+	"github.com/jackc/pgx/v5/pgxpool"
+	"github.com/jackc/pgx/v5/stdlib"
+	"github.com/jmoiron/sqlx"
+)
+
+// The client library used to talk to a Postgres scenario.
+// Results are labeled with it, e.g. SameBox/pgx, so we can compare driver overhead.
+type PostgresClient string
+
+const (
+	LibPQ     PostgresClient = "pq"      // lib/pq through database/sql
+	PgxStdlib PostgresClient = "pgx"     // pgx through database/sql (stdlib mode)
+	PgxPool   PostgresClient = "pgxpool" // pgx's native pgxpool API
+)
+
+// Returns the clients configured for a Postgres simulation type.
+// They come from a comma separated env variable, e.g. "pq,pgx,pgxpool".
+func postgresClients(simulationType SimulationType) ([]PostgresClient, error) {
+	var value string
+	switch simulationType {
+	case SameBox:
+		value = common.Env.SAME_BOX_POSTGRES_CLIENTS
+	case IntraAZ:
+		value = common.Env.INTRA_AZ_POSTGRES_CLIENTS
+	case InterAZ:
+		value = common.Env.INTER_AZ_POSTGRES_CLIENTS
+	case InterRegion:
+		value = common.Env.INTER_REGION_POSTGRES_CLIENTS
+	}
+
+	clients := []PostgresClient{}
+	for _, name := range strings.Split(value, ",") {
+		client := PostgresClient(strings.TrimSpace(name))
+		switch client {
+		case "":
+			continue
+		case LibPQ, PgxStdlib, PgxPool:
+			clients = append(clients, client)
+		default:
+			return nil, fmt.Errorf("unknown postgres client %q for %s", client, simulationType)
+		}
+	}
+	return clients, nil
+}
+
+// Connects to a Postgres database with the given client.
+//
+// Every target gets a pgxpool, which the pgx-only workloads (e.g. COPY) use
+// no matter the client. For the pgxpool client, the sqlx db used for setup &
+// seeding is a database/sql wrapper around that same pool, and the workloads
+// send their queries through the pool directly.
+func openPostgres(dsn string, client PostgresClient) (*target, error) {
+	pool, err := pgxpool.New(context.Background(), dsn)
+	if err != nil {
+		return nil, err
+	}
+
+	t := &target{dsn: dsn, pool: pool}
+	switch client {
+	case LibPQ:
+		t.db, err = sqlx.Open("postgres", dsn)
+	case PgxStdlib:
+		t.db, err = sqlx.Open("pgx", dsn)
+	case PgxPool:
+		t.db = sqlx.NewDb(stdlib.OpenDBFromPool(pool), "pgx")
+		t.native = true
+	default:
+		err = fmt.Errorf("unknown postgres client %q", client)
+	}
+	if err != nil {
+		pool.Close()
+		return nil, err
+	}
+	return t, nil
+}
@@ -1,9 +1,17 @@
 package latency_simulations
 
 import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
 	"fmt"
 	"go-on-rails/common"
+	"hash/fnv"
+	"log"
+	"math"
 	"math/rand"
+	"strings"
 	"sync"
 	"time"
 
@@ -11,6 +19,9 @@ import (
 	_ "github.com/lib/pq"
 	_ "github.com/mattn/go-sqlite3"
 	"github.com/montanaflynn/stats"
+	"github.com/redis/go-redis/v9"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/trace"
 )
 
 func init() {
@@ -20,8 +31,41 @@ func init() {
 	}
 }
 
+// Held while a simulation runs, since they all share the same tables.
 var allLock sync.Mutex
 
+// Runs triggered from the UI go through the simulations queue, as a single
+// lockable job: another run can't be queued while one is queued or running,
+// and a run interrupted by a restart starts again. Scheduled runs are
+// skipped instead when allLock is held, see scheduler.go.
+var simulationQueue = newSimulationQueue()
+
+const simulateJob = "simulate"
+
+func newSimulationQueue() *common.Queue {
+	queue := common.NewQueue("simulations", 1)
+	// a failed run is reported through webhooks & emails and can be re-run
+	// from the jobs page, retrying it right away would likely fail again
+	queue.Handle(simulateJob, common.JobOptions{Lockable: true, MaxAttempts: 1}, func(job common.Job) error {
+		var opts SimulationOptions
+		err := json.Unmarshal([]byte(job.Payload), &opts)
+		if err != nil {
+			return err
+		}
+		return simulateAll(opts)
+	})
+	return queue
+}
+
+// Starts running the queued simulations and webhook deliveries.
+func StartWorkers() error {
+	err := simulationQueue.Start()
+	if err != nil {
+		return err
+	}
+	return webhookQueue.Start()
+}
+
 type SimulationType string
 
 const (
@@ -30,59 +74,337 @@ const (
 	IntraAZ     SimulationType = "intra_az"
 	InterAZ     SimulationType = "inter_az"
 	InterRegion SimulationType = "inter_region"
+	Cache       SimulationType = "cache"
 )
 
-func simulateAll() error {
-	allLock.Lock()
-	defer allLock.Unlock()
+// Options that tweak how a simulation run behaves.
+// They are parsed from the form posted to the /simulate route.
+type SimulationOptions struct {
+	// Samples server-side time with EXPLAIN ANALYZE for Postgres scenarios,
+	// so we can estimate how much of each latency is network overhead.
+	ServerTiming bool `query:"server_timing" form:"server_timing"`
+
+	// Also runs the base workloads with prepared statements and, for Postgres,
+	// with pgx's statement cache. See querymodes.go.
+	QueryModes bool `query:"query_modes" form:"query_modes"`
+
+	// Number of statements between BEGIN and COMMIT in the transaction workloads.
+	TxStatements int `query:"tx_statements" form:"tx_statements"`
+
+	// Only run the transaction workloads with this isolation level or locking
+	// mode, e.g. "serializable" or "immediate". Empty runs all of them.
+	TxIsolation string `query:"tx_isolation" form:"tx_isolation"`
+
+	// Percentage of cache-aside reads that hit the cache, from 0 to 100.
+	// Only used when a cache is configured, see cache.go.
+	CacheHitRatio int `query:"cache_hit_ratio" form:"cache_hit_ratio"`
+
+	// Which products the keyed workloads look up, see distributions.go.
+	KeyDistribution KeyDistribution `query:"key_distribution" form:"key_distribution"`
+
+	// Overrides the key distribution of some workloads,
+	// e.g. "Read2=zipfian,LocalCache=hotspot".
+	WorkloadDistributions string `query:"workload_distributions" form:"workload_distributions"`
+
+	// Parameters of the zipfian & latest, and of the hotspot distributions.
+	ZipfianSkew float64 `query:"zipfian_skew" form:"zipfian_skew"`
+	HotspotOps  int     `query:"hotspot_ops" form:"hotspot_ops"`
+	HotspotKeys int     `query:"hotspot_keys" form:"hotspot_keys"`
+
+	// Size of the seeded dataset and number of measured operations.
+	// Reviews are PayloadSize bytes long, or a short text when it's 0,
+	// to see how result-set size interacts with bandwidth.
+	Products          int `query:"products" form:"products"`
+	ReviewsPerProduct int `query:"reviews_per_product" form:"reviews_per_product"`
+	Queries           int `query:"queries" form:"queries"`
+	PayloadSize       int `query:"payload_size" form:"payload_size"`
+
+	// Seeds every random choice of the run: seeded prices, picked keys, etc.
+	// Runs with the same seed and options issue the same operations.
+	// When it's 0, the seed of the latest run is reused so its dataset can
+	// be too (see fixtures.go), or a random one is picked for the first run.
+	Seed int64 `query:"seed" form:"seed"`
+
+	// Re-seeds the dataset even if the existing one matches. Without an
+	// explicit seed, this also picks a fresh random seed.
+	ResetDataset bool `query:"reset_dataset" form:"reset_dataset"`
+
+	// Parsed WorkloadDistributions, set by validate.
+	workloadDistributions map[string]KeyDistribution
+
+	// When set, only these workloads run, see Scenario.Workloads.
+	onlyWorkloads map[string]bool
+
+	// Set for all but the first client of a Postgres scenario, so the
+	// workloads that go through pgxpool whatever the client run once.
+	skipPoolWorkloads bool
+}
 
-	var err error
+// Returns options with the defaults of fields whose zero value is meaningful,
+// to be overridden by the posted form.
+func newSimulationOptions() SimulationOptions {
+	return SimulationOptions{CacheHitRatio: defaultCacheHitRatio, ReviewsPerProduct: defaultReviewsPerProduct}
+}
+
+// Sets default values for options that weren't provided and
+// clamps the ones that are out of range.
+func (o *SimulationOptions) setDefaults() {
+	if o.TxStatements <= 0 {
+		o.TxStatements = defaultTxStatements
+	}
+	if o.TxStatements > maxTxStatements {
+		o.TxStatements = maxTxStatements
+	}
+	o.CacheHitRatio = min(max(o.CacheHitRatio, 0), 100)
+	if o.KeyDistribution == "" {
+		o.KeyDistribution = Uniform
+	}
+	if o.ZipfianSkew == 0 {
+		o.ZipfianSkew = defaultZipfianSkew
+	}
+	if o.HotspotOps <= 0 {
+		o.HotspotOps = defaultHotspotOps
+	}
+	if o.HotspotKeys <= 0 {
+		o.HotspotKeys = defaultHotspotKeys
+	}
+	o.HotspotOps = min(o.HotspotOps, 100)
+	o.HotspotKeys = min(o.HotspotKeys, 100)
+	if o.Products <= 0 {
+		o.Products = defaultProductCount
+	}
+	o.Products = min(max(o.Products, minProductCount), maxProductCount)
+	o.ReviewsPerProduct = min(max(o.ReviewsPerProduct, 0), maxReviewsPerProduct)
+	if o.Queries <= 0 {
+		o.Queries = defaultQueryCount
+	}
+	o.Queries = min(max(o.Queries, minQueryCount), maxQueryCount)
+	o.PayloadSize = min(max(o.PayloadSize, 0), maxPayloadSize)
+	for o.Seed == 0 {
+		o.Seed = rand.Int63()
+	}
+}
+
+// Checks the options that can't be fixed up with a default.
+func (o *SimulationOptions) validate() error {
+	// rand.NewZipf needs a finite skew above 1
+	if o.ZipfianSkew != 0 && (o.ZipfianSkew <= 1 || math.IsNaN(o.ZipfianSkew) || math.IsInf(o.ZipfianSkew, 0)) {
+		return fmt.Errorf("the zipfian skew must be greater than 1, got %g", o.ZipfianSkew)
+	}
 
-	sqliteSim, err := simulate(SQLite)
+	err := validTxIsolation(o.TxIsolation)
 	if err != nil {
 		return err
 	}
-
-	sameBoxSim, err := simulate(SameBox)
+	o.KeyDistribution, err = parseKeyDistribution(string(o.KeyDistribution))
 	if err != nil {
 		return err
 	}
+	o.workloadDistributions, err = parseWorkloadDistributions(o.WorkloadDistributions)
+	return err
+}
+
+// Returns a random source for one stream of random choices of the run, e.g.
+// a workload. Each stream gets its own source derived from the seed, so a
+// stream's choices don't depend on which other streams ran before it.
+func newRand(seed int64, stream string) *rand.Rand {
+	h := fnv.New64a()
+	h.Write([]byte(stream))
+	return rand.New(rand.NewSource(seed ^ int64(h.Sum64())))
+}
 
-	intraAZSim, err := simulate(IntraAZ)
+// Returns the key distribution the given workload runs with.
+func (o SimulationOptions) keyDistribution(workload string) KeyDistribution {
+	if d, ok := o.workloadDistributions[workload]; ok {
+		return d
+	}
+	return o.KeyDistribution
+}
+
+// Runs every scenario and replaces the latency logs. Waits for the
+// simulation in progress, if any, to finish first.
+func simulateAll(opts SimulationOptions) error {
+	allLock.Lock()
+	defer allLock.Unlock()
+
+	_, err := runSimulations(opts, nil)
+	return err
+}
+
+// Like simulateAll, but returns right away with ran = false when a simulation
+// is already in progress, instead of queuing up. When a scenario is given,
+// only that one runs and only its latency logs are replaced.
+// Used by scheduled runs, see scheduler.go.
+func trySimulateAll(opts SimulationOptions, scenario *Scenario) (runID int64, ran bool, err error) {
+	if !allLock.TryLock() {
+		return 0, false, nil
+	}
+	defer allLock.Unlock()
+
+	runID, err = runSimulations(opts, scenario)
+	return runID, true, err
+}
+
+// Must be called with allLock held. Returns the id of the recorded run,
+// which is recorded even if it fails.
+// The configured webhooks and summary recipients are told whether the run
+// completed or failed, see webhooks.go and notifiers.go, and the run is
+// counted in the metrics, see metrics.go.
+func runSimulations(opts SimulationOptions, only *Scenario) (runID int64, err error) {
+	start := time.Now()
+	ctx, span := tracer.Start(context.Background(), "simulateAll")
+	if only != nil {
+		span.SetAttributes(scenarioAttribute.String(only.Label()))
+	}
+	defer func() {
+		if err != nil {
+			var recordErr error
+			runID, recordErr = insertFailedRun(opts, err)
+			if recordErr != nil {
+				log.Printf("Error recording a failed run: %v", recordErr)
+			}
+		}
+		span.SetAttributes(attribute.Int64("simulation.run_id", runID))
+		endSpan(span, err)
+		observeRun(start, err)
+		deliverRunWebhooks(runID, err)
+		emailRunSummary(runID, err)
+	}()
+	return simulateScenarios(ctx, opts, only)
+}
+
+func simulateScenarios(ctx context.Context, opts SimulationOptions, only *Scenario) (runID int64, err error) {
+	if opts.Seed == 0 && !opts.ResetDataset {
+		run, err := latestRun()
+		if err != nil {
+			return 0, err
+		}
+		if run != nil {
+			runOpts, err := run.SimulationOptions()
+			if err != nil {
+				return 0, err
+			}
+			opts.Seed = runOpts.Seed
+		}
+	}
+
+	opts.setDefaults()
+	err = opts.validate()
 	if err != nil {
-		return err
+		return 0, err
 	}
+	trace.SpanFromContext(ctx).SetAttributes(
+		attribute.Int64("simulation.seed", opts.Seed),
+		attribute.Int("simulation.products", opts.Products),
+		attribute.Int("simulation.reviews_per_product", opts.ReviewsPerProduct),
+		attribute.Int("simulation.queries", opts.Queries),
+	)
 
-	interAZSim, err := simulate(InterAZ)
+	scenarios := []scenarioSimulation{}
+
+	cache, closeCache, err := openCache(opts)
 	if err != nil {
-		return err
+		return 0, err
 	}
+	defer closeCache()
 
-	interRegionSim, err := simulate(InterRegion)
+	// a scheduled run of a single managed scenario skips the built-in ones
+	if only == nil {
+		sqliteSim, err := simulate(ctx, "SQLite", SQLite, "", nil, opts)
+		if err != nil {
+			return 0, err
+		}
+		scenarios = append(scenarios, scenarioSimulation{label: "SQLite", sim: sqliteSim})
+
+		// every postgres scenario runs once per configured client, e.g. SameBox/pgx
+		postgresScenarios := []struct {
+			label          string
+			simulationType SimulationType
+		}{
+			{"SameBox", SameBox},
+			{"IntraAZ", IntraAZ},
+			{"InterAZ", InterAZ},
+			{"InterRegion", InterRegion},
+		}
+		for _, scenario := range postgresScenarios {
+			clients, err := postgresClients(scenario.simulationType)
+			if err != nil {
+				return 0, err
+			}
+			for i, client := range clients {
+				clientOpts := opts
+				clientOpts.skipPoolWorkloads = i > 0
+				sim, err := simulate(ctx, scenario.label+"/"+string(client), scenario.simulationType, client, cache, clientOpts)
+				if err != nil {
+					return 0, err
+				}
+				scenarios = append(scenarios, scenarioSimulation{scenario.label + "/" + string(client), client, sim})
+			}
+		}
+
+		if cache != nil {
+			cacheSim, err := simulate(ctx, "Cache", Cache, "", cache, opts)
+			if err != nil {
+				return 0, err
+			}
+			scenarios = append(scenarios, scenarioSimulation{label: "Cache", sim: cacheSim})
+		}
+	}
+
+	// scenarios managed in the UI, see scenarios.go
+	managedScenarios, err := enabledScenarios()
 	if err != nil {
-		return err
+		return 0, err
+	}
+	if only != nil {
+		managedScenarios = []Scenario{*only}
+	}
+	for _, scenario := range managedScenarios {
+		scenarioCtx, span := startScenario(ctx, scenario.Label())
+		sim, err := scenario.simulate(scenarioCtx, cache, opts)
+		endSpan(span, err)
+		if err != nil {
+			return 0, fmt.Errorf("%s: %w", scenario.Label(), err)
+		}
+		scenarios = append(scenarios, scenarioSimulation{scenario.Label(), scenario.Driver, sim})
 	}
 
 	tx, err := db.Beginx()
 	if err != nil {
-		return err
+		return 0, err
 	}
+	// a failed run leaves the previous logs in place
 	defer func() {
-		if err != nil {
-			tx.Rollback()
-			panic(err)
+		if err == nil {
+			return
+		}
+		runID = 0
+		rollbackErr := tx.Rollback()
+		if rollbackErr != nil && !errors.Is(rollbackErr, sql.ErrTxDone) {
+			err = fmt.Errorf("%w, and rolling back its logs failed: %v", err, rollbackErr)
 		}
 	}()
 
-	// drop table if it exists; ensures a clean slate
-	_, err = tx.Exec(`DROP TABLE IF EXISTS latency_logs`)
+	runID, err = insertRun(tx, opts)
 	if err != nil {
-		return err
+		return 0, err
+	}
+
+	// drop table if it exists; ensures a clean slate
+	if only == nil {
+		_, err = tx.Exec(`DROP TABLE IF EXISTS latency_logs`)
+		if err != nil {
+			return 0, err
+		}
 	}
 
 	// create table if it doesn't exist
 	_, err = tx.Exec(`CREATE TABLE IF NOT EXISTS latency_logs (
 			label TEXT NOT NULL PRIMARY KEY,
+			run_id INTEGER REFERENCES simulation_runs (id),
+			scenario TEXT NOT NULL,
+			workload TEXT NOT NULL,
+			key_distribution TEXT NOT NULL DEFAULT '',
 			median_latency REAL,
 			p10_latency REAL,
 			p25_latency REAL,
@@ -90,52 +412,67 @@ func simulateAll() error {
 			p90_latency REAL,
 			p95_latency REAL,
 			count REAL,
+			retries REAL,
+			rows_per_sec REAL,
+			per_query_latency REAL,
+			server_latency REAL,
+			network_latency REAL,
+			baseline_ratio REAL,
+			cache_hits REAL,
+			cache_misses REAL,
 			created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
 			updated_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP
 		)`)
 	if err != nil {
-		return err
+		return 0, err
+	}
+	// a run of a single scenario keeps the logs of the previous run
+	for _, column := range []string{"cache_hits", "cache_misses"} {
+		err = addMissingColumn(tx, "latency_logs", column, "REAL")
+		if err != nil {
+			return 0, err
+		}
 	}
 
 	// create index on label
 	_, err = tx.Exec(`CREATE INDEX IF NOT EXISTS idx_label ON latency_logs (label)`)
 	if err != nil {
-		return err
+		return 0, err
 	}
 
-	logs := []struct {
-		label string
-		stats LatencyStats
-	}{
-		{"SQLite Read1", sqliteSim.Read1},
-		{"SQLite Read2", sqliteSim.Read2},
-		{"SQLite Write1", sqliteSim.Write1},
-		{"SameBox Read1", sameBoxSim.Read1},
-		{"SameBox Read2", sameBoxSim.Read2},
-		{"SameBox Write1", sameBoxSim.Write1},
-		{"IntraAZ Read1", intraAZSim.Read1},
-		{"IntraAZ Read2", intraAZSim.Read2},
-		{"IntraAZ Write1", intraAZSim.Write1},
-		{"InterAZ Read1", interAZSim.Read1},
-		{"InterAZ Read2", interAZSim.Read2},
-		{"InterAZ Write1", interAZSim.Write1},
-		{"InterRegion Read1", interRegionSim.Read1},
-		{"InterRegion Read2", interRegionSim.Read2},
-		{"InterRegion Write1", interRegionSim.Write1},
-	}
-	for _, log := range logs {
-		err = logLatency(tx, log.label, log.stats)
-		if err != nil {
-			return err
+	for _, scenario := range scenarios {
+		// only the logs of the scenario that ran are replaced
+		if only != nil {
+			_, err = tx.Exec(`DELETE FROM latency_logs WHERE scenario = ?`, scenario.label)
+			if err != nil {
+				return 0, err
+			}
+		}
+
+		baseline := scenario.sim.baseline()
+		workloads := append([]WorkloadResult{
+			{Name: "TCPConnect", Stats: scenario.sim.TCPConnect},
+			{Name: "Select1", Stats: scenario.sim.Select1},
+		}, scenario.sim.Workloads...)
+		for _, workload := range workloads {
+			// e.g. there is no TCP connect baseline for SQLite
+			if workload.Stats.Count == 0 {
+				continue
+			}
+			err = logLatency(tx, runID, scenario.label, workload, baseline, historyFingerprint(opts, scenario.client, workload))
+			if err != nil {
+				return 0, err
+			}
 		}
 	}
 
 	err = tx.Commit()
 	if err != nil {
-		return err
+		return 0, err
 	}
 
-	return nil
+	alertOnAnomalies(runID)
+	return runID, nil
 }
 
 type LatencyStats struct {
@@ -146,80 +483,206 @@ type LatencyStats struct {
 	P90Latency    float64
 	P95Latency    float64
 	Count         float64
+	Retries       float64 // operations retried after a serialization failure
+	RowsPerSecond float64 // only set for workloads that write batches of rows
+
+	// Reads served by the cache and reads that fell through to the database.
+	// Only set for workloads reading through a cache.
+	CacheHits   float64
+	CacheMisses float64
+
+	// Median latency divided by the logical queries per operation.
+	// Only set for workloads that send several queries at once.
+	PerQueryLatency float64
+
+	// Only set when server timing is sampled (see SimulationOptions).
+	ServerLatency  float64 // median time spent planning & executing on the server
+	NetworkLatency float64 // estimated network overhead: median latency - server latency
 }
 
 type Simulation struct {
-	Read1  LatencyStats
-	Read2  LatencyStats
-	Write1 LatencyStats
+	// Baselines, see baseline.go
+	TCPConnect LatencyStats
+	Select1    LatencyStats
+
+	// Measured workloads in the order they ran, see workloads.go
+	Workloads []WorkloadResult
+}
+
+// A simulation together with the label of the scenario it ran for.
+type scenarioSimulation struct {
+	label  string
+	client PostgresClient // empty for SQLite & the cache
+	sim    Simulation
 }
 
-// Runs the latency simulation for the given simulation type
-func simulate(simulationType SimulationType) (Simulation, error) {
+type WorkloadResult struct {
+	Name  string
+	Stats LatencyStats
+
+	// Empty for workloads that don't pick products, see distributions.go.
+	KeyDistribution KeyDistribution
+}
+
+// Returns the median latency every workload of this simulation is compared to.
+// That's the TCP connect RTT when we have one, otherwise the `SELECT 1` round trip.
+func (s Simulation) baseline() float64 {
+	if s.TCPConnect.Count > 0 {
+		return s.TCPConnect.MedianLatency
+	}
+	return s.Select1.MedianLatency
+}
+
+// Runs the latency simulation for the given simulation type, traced as the
+// scenario with the given label.
+// The client is only used for Postgres simulations. The cache, if any,
+// is used by the Cache simulation and by Postgres' cache-aside workload.
+func simulate(ctx context.Context, label string, simulationType SimulationType, client PostgresClient, cache *redis.Client, opts SimulationOptions) (sim Simulation, err error) {
+	// Postgres scenarios without a configured database are skipped, untraced
+	dbURL := postgresURL(simulationType)
+	if simulationType != SQLite && simulationType != Cache && dbURL == "" {
+		return Simulation{}, nil
+	}
+	ctx, span := startScenario(ctx, label)
+	defer func() { endSpan(span, err) }()
+
 	// if sqlite, use the default db
 	if simulationType == SQLite {
-		return simulateSQLiteLatency(db)
+		select1, err := measureSelect1(ctx, &target{db: db}, opts.Queries)
+		if err != nil {
+			return Simulation{}, err
+		}
+		sim, err := simulateSQLiteLatency(ctx, db, opts)
+		sim.Select1 = select1
+		return sim, err
+	}
+
+	if simulationType == Cache {
+		return simulateCache(ctx, cache, opts)
 	}
 
-	// otherwise, use the appropriate db url
-	var dbURL string
+	// otherwise, use the Postgres db url
+	return simulatePostgres(ctx, dbURL, client, cache, opts)
+}
+
+// Runs the latency simulation against the Postgres database at the URL.
+func simulatePostgres(ctx context.Context, dbURL string, client PostgresClient, cache *redis.Client, opts SimulationOptions) (Simulation, error) {
+	// connect to postgres with the given client, inside the benchmark schema
+	dsn, err := benchDSN(dbURL)
+	if err != nil {
+		return Simulation{}, err
+	}
+	t, err := openPostgres(dsn, client)
+	if err != nil {
+		return Simulation{}, err
+	}
+	defer t.close()
+
+	err = guardBenchSchema(t.db)
+	if err != nil {
+		return Simulation{}, err
+	}
+	t.cache = cache
+	t.products = opts.Products
+	t.ctx = ctx
+
+	// measure the baselines before seeding, so they aren't affected by it
+	addr, err := dsnHostPort(dbURL)
+	if err != nil {
+		return Simulation{}, err
+	}
+	tcpConnect, err := measureTCPConnect(ctx, addr, opts.Queries)
+	if err != nil {
+		return Simulation{}, err
+	}
+	select1, err := measureSelect1(ctx, t, opts.Queries)
+	if err != nil {
+		return Simulation{}, err
+	}
+
+	// run the simulation
+	sim, err := simulatePostgresLatency(ctx, t, opts)
+	sim.TCPConnect = tcpConnect
+	sim.Select1 = select1
+	return sim, err
+}
+
+// Returns the connection URL of a Postgres simulation type.
+func postgresURL(simulationType SimulationType) string {
 	switch simulationType {
 	case SameBox:
-		dbURL = common.Env.SAME_BOX_POSTGRES_URL
+		return common.Env.SAME_BOX_POSTGRES_URL
 	case IntraAZ:
-		dbURL = common.Env.INTRA_AZ_POSTGRES_URL
+		return common.Env.INTRA_AZ_POSTGRES_URL
 	case InterAZ:
-		dbURL = common.Env.INTER_AZ_POSTGRES_URL
+		return common.Env.INTER_AZ_POSTGRES_URL
 	case InterRegion:
-		dbURL = common.Env.INTER_REGION_POSTGRES_URL
+		return common.Env.INTER_REGION_POSTGRES_URL
 	default:
-		return Simulation{}, nil
+		return ""
 	}
+}
 
-	// instantiate a new postgres db
-	localDb, err := sqlx.Open("postgres", dbURL)
+// Defaults and limits of the dataset options, see SimulationOptions.
+// The limits keep a run from seeding for hours over inter-region links.
+const (
+	defaultProductCount      = 1_000
+	defaultReviewsPerProduct = 10
+	defaultQueryCount        = 100
+
+	minProductCount      = 100
+	maxProductCount      = 100_000
+	minQueryCount        = 10 // the P10 needs at least 10 latencies
+	maxReviewsPerProduct = 100
+	maxQueryCount        = 10_000
+	maxPayloadSize       = 64 << 10 // bytes
+)
+
+func simulateSQLiteLatency(ctx context.Context, db *sqlx.DB, opts SimulationOptions) (Simulation, error) {
+	err := prepareDataset(ctx, db, opts, createSQLiteTables)
 	if err != nil {
 		return Simulation{}, err
 	}
-	defer localDb.Close()
 
-	// run the simulation
-	return simulatePostgresLatency(localDb)
+	results, err := runWorkloads(&target{db: db, products: opts.Products, ctx: ctx}, opts)
+	if err != nil {
+		return Simulation{Workloads: results}, err
+	}
+	return Simulation{Workloads: results}, restoreDataset(db, opts)
 }
 
-const (
-	productCount          = 1_000
-	reviewCountPerProduct = 10
-	queryCount            = 100
-)
-
-func simulateSQLiteLatency(db *sqlx.DB) (Simulation, error) {
-	var err error
-
-	// drop tables if they exist; ensures a clean slate
-	_, err = db.Exec(`DROP TABLE IF EXISTS product_reviews`)
+func simulatePostgresLatency(ctx context.Context, t *target, opts SimulationOptions) (Simulation, error) {
+	err := prepareDataset(ctx, t.db, opts, createPostgresTables)
 	if err != nil {
 		return Simulation{}, err
 	}
-	_, err = db.Exec(`DROP TABLE IF EXISTS products`)
+
+	results, err := runWorkloads(t, opts)
 	if err != nil {
-		return Simulation{}, err
+		return Simulation{Workloads: results}, err
 	}
+	return Simulation{Workloads: results}, restoreDataset(t.db, opts)
+}
+
+// Creates the SQLite tables the workloads run against.
+func createSQLiteTables(db *sqlx.DB) error {
+	var err error
 
 	// create table for products
 	_, err = db.Exec(`CREATE TABLE IF NOT EXISTS products (
 		id INTEGER PRIMARY KEY AUTOINCREMENT,
 		name TEXT NOT NULL,
-		price REAL NOT NULL
+		price REAL NOT NULL,
+		seeded_price REAL -- restored after each run, see restoreDataset
 	)`)
 	if err != nil {
-		return Simulation{}, err
+		return err
 	}
 
 	// add index on name
 	_, err = db.Exec(`CREATE INDEX IF NOT EXISTS idx_products_name ON products (name)`)
 	if err != nil {
-		return Simulation{}, err
+		return err
 	}
 
 	// create table for product reviews
@@ -229,148 +692,36 @@ func simulateSQLiteLatency(db *sqlx.DB) (Simulation, error) {
 		review TEXT NOT NULL
 	)`)
 	if err != nil {
-		return Simulation{}, err
+		return err
 	}
 
 	// add index on product_id
 	_, err = db.Exec(`CREATE INDEX IF NOT EXISTS idx_product_reviews_product_id ON product_reviews (product_id)`)
 	if err != nil {
-		return Simulation{}, err
-	}
-
-	// seed with products
-	tx, err := db.Begin()
-	if err != nil {
-		return Simulation{}, err
-	}
-	for i := 0; i < productCount; i++ {
-		_, err := tx.Exec(`INSERT INTO products (name, price) VALUES (?, ?)`, fmt.Sprintf("product%d", i), rand.Float64()*100)
-		if err != nil {
-			tx.Rollback()
-			return Simulation{}, err
-		}
-	}
-	if err := tx.Commit(); err != nil {
-		return Simulation{}, err
-	}
-
-	// seed each product with reviews
-	tx, err = db.Begin()
-	if err != nil {
-		return Simulation{}, err
-	}
-	for i := 0; i < productCount; i++ {
-		for j := 0; j < reviewCountPerProduct; j++ {
-			_, err := tx.Exec(`INSERT INTO product_reviews (product_id, review) VALUES (?, ?)`, i, fmt.Sprintf("review%d", j))
-			if err != nil {
-				tx.Rollback()
-				return Simulation{}, err
-			}
-		}
-	}
-	if err := tx.Commit(); err != nil {
-		return Simulation{}, err
-	}
-
-	// run 100 read queries where you get the 100 most expensive products and measure the latency
-	latenciesRead1 := []time.Duration{}
-	for i := 0; i < queryCount; i++ {
-		start := time.Now()
-		var id int
-		var name string
-		var price float64
-		err = db.QueryRow(`SELECT id, name, price FROM products ORDER BY price DESC LIMIT 1`).Scan(&id, &name, &price)
-		if err != nil {
-			return Simulation{}, err
-		}
-		latenciesRead1 = append(latenciesRead1, time.Since(start))
-	}
-	statsRead1, err := calculateLatencyStatsNs(latenciesRead1)
-	if err != nil {
-		return Simulation{
-			Read1: statsRead1,
-		}, err
-	}
-
-	// run 100 read queries where you get a random product and measure the latency
-	latenciesRead2 := []time.Duration{}
-	for i := 0; i < queryCount; i++ {
-		start := time.Now()
-		var id int
-		var name string
-		var price float64
-		err = db.QueryRow(`SELECT id, name, price FROM products WHERE name = ? LIMIT 1`, fmt.Sprintf("product%d", rand.Intn(productCount))).Scan(&id, &name, &price)
-		if err != nil {
-			return Simulation{
-				Read1: statsRead1,
-			}, err
-		}
-		latenciesRead2 = append(latenciesRead2, time.Since(start))
-	}
-	statsRead2, err := calculateLatencyStatsNs(latenciesRead2)
-	if err != nil {
-		return Simulation{
-			Read1: statsRead1,
-			Read2: statsRead2,
-		}, err
-	}
-
-	// add 100 new products and measure the latency
-	latenciesWrite1 := []time.Duration{}
-	for i := 0; i < queryCount; i++ {
-		start := time.Now()
-		_, err = db.Exec(`INSERT INTO products (name, price) VALUES (?, ?)`, fmt.Sprintf("product%d", i), rand.Float64()*100)
-		if err != nil {
-			return Simulation{
-				Read1: statsRead1,
-				Read2: statsRead2,
-			}, err
-		}
-		latenciesWrite1 = append(latenciesWrite1, time.Since(start))
-	}
-	statsWrite1, err := calculateLatencyStatsNs(latenciesWrite1)
-	if err != nil {
-		return Simulation{
-			Read1:  statsRead1,
-			Read2:  statsRead2,
-			Write1: statsWrite1,
-		}, err
+		return err
 	}
-
-	return Simulation{
-		Read1:  statsRead1,
-		Read2:  statsRead2,
-		Write1: statsWrite1,
-	}, nil
+	return nil
 }
 
-func simulatePostgresLatency(db *sqlx.DB) (Simulation, error) {
+// Creates the Postgres tables the workloads run against.
+func createPostgresTables(db *sqlx.DB) error {
 	var err error
 
-	// drop tables if they exist; ensures a clean slate
-	_, err = db.Exec(`DROP TABLE IF EXISTS product_reviews`)
-	if err != nil {
-		return Simulation{}, err
-	}
-	_, err = db.Exec(`DROP TABLE IF EXISTS products`)
-	if err != nil {
-		return Simulation{}, err
-	}
-
 	// create table for products
 	_, err = db.Exec(`CREATE TABLE IF NOT EXISTS products (
 		id SERIAL PRIMARY KEY,
 		name TEXT NOT NULL,
-		price REAL NOT NULL
+		price REAL NOT NULL,
+		seeded_price REAL -- restored after each run, see restoreDataset
 	)`)
 	if err != nil {
-		return Simulation{}, err
+		return err
 	}
 
 	// add index on name
 	_, err = db.Exec(`CREATE INDEX IF NOT EXISTS idx_products_name ON products (name)`)
 	if err != nil {
-		return Simulation{}, err
+		return err
 	}
 
 	// create table for product reviews
@@ -380,119 +731,113 @@ func simulatePostgresLatency(db *sqlx.DB) (Simulation, error) {
 		review TEXT NOT NULL
 	)`)
 	if err != nil {
-		return Simulation{}, err
+		return err
 	}
 
 	// add index on product_id
 	_, err = db.Exec(`CREATE INDEX IF NOT EXISTS idx_product_reviews_product_id ON product_reviews (product_id)`)
 	if err != nil {
-		return Simulation{}, err
+		return err
 	}
+	return nil
+}
+
+// Seeds the products and product_reviews tables with the dataset size of
+// the options. The queries are written with `?` placeholders and rebound
+// for the driver, so this works for both SQLite and Postgres.
+func seed(db *sqlx.DB, opts SimulationOptions) error {
+	r := newRand(opts.Seed, "seed")
 
-	// seed with 1000 products
-	tx, err := db.Begin()
+	// seed with products
+	tx, err := db.Beginx()
 	if err != nil {
-		return Simulation{}, err
+		return err
 	}
-	for i := 0; i < productCount; i++ {
-		_, err := tx.Exec(`INSERT INTO products (name, price) VALUES ($1, $2)`, fmt.Sprintf("product%d", i), rand.Float64()*100)
+	for i := 0; i < opts.Products; i++ {
+		price := r.Float64() * 100
+		_, err := tx.Exec(tx.Rebind(`INSERT INTO products (name, price, seeded_price) VALUES (?, ?, ?)`), fmt.Sprintf("product%d", i), price, price)
 		if err != nil {
 			tx.Rollback()
-			return Simulation{}, err
+			return err
 		}
 	}
 	if err := tx.Commit(); err != nil {
-		return Simulation{}, err
+		return err
 	}
 
-	// seed each product with 10 reviews
-	tx, err = db.Begin()
+	// seed each product with reviews; product ids start at 1
+	tx, err = db.Beginx()
 	if err != nil {
-		return Simulation{}, err
+		return err
 	}
-	for i := 0; i < productCount; i++ {
-		for j := 0; j < reviewCountPerProduct; j++ {
-			_, err := tx.Exec(`INSERT INTO product_reviews (product_id, review) VALUES ($1, $2)`, i, fmt.Sprintf("review%d", j))
+	for i := 1; i <= opts.Products; i++ {
+		for j := 0; j < opts.ReviewsPerProduct; j++ {
+			_, err := tx.Exec(tx.Rebind(`INSERT INTO product_reviews (product_id, review) VALUES (?, ?)`), i, reviewBody(j, opts.PayloadSize))
 			if err != nil {
 				tx.Rollback()
-				return Simulation{}, err
+				return err
 			}
 		}
 	}
-	if err := tx.Commit(); err != nil {
-		return Simulation{}, err
-	}
+	return tx.Commit()
+}
 
-	// run 100 read queries where you get the 100 most expensive products and measure the latency
-	latenciesRead1 := []time.Duration{}
-	for i := 0; i < queryCount; i++ {
-		start := time.Now()
-		var id int
-		var name string
-		var price float64
-		err = db.QueryRow(`SELECT id, name, price FROM products ORDER BY price DESC LIMIT 1`).Scan(&id, &name, &price)
-		if err != nil {
-			return Simulation{}, err
-		}
-		latenciesRead1 = append(latenciesRead1, time.Since(start))
+// Returns the j-th review of a product, padded to the payload size if set.
+func reviewBody(j int, payloadSize int) string {
+	review := fmt.Sprintf("review%d", j)
+	if payloadSize <= len(review) {
+		return review
 	}
-	statsRead1, err := calculateLatencyStatsNs(latenciesRead1)
+	return review + strings.Repeat("x", payloadSize-len(review))
+}
+
+// Runs the query with EXPLAIN (ANALYZE, FORMAT JSON) and returns the time
+// Postgres reports for planning and executing it. This excludes the time
+// spent on the wire, which is what we want to separate out.
+func explainAnalyze(db sqlx.Queryer, query string, args ...any) (time.Duration, error) {
+	var raw []byte
+	err := db.QueryRowx(`EXPLAIN (ANALYZE, FORMAT JSON) `+query, args...).Scan(&raw)
 	if err != nil {
-		return Simulation{
-			Read1: statsRead1,
-		}, err
+		return 0, err
 	}
 
-	// run 100 read queries where you get a random product and measure the latency
-	latenciesRead2 := []time.Duration{}
-	for i := 0; i < queryCount; i++ {
-		start := time.Now()
-		var id int
-		var name string
-		var price float64
-		err = db.QueryRow(`SELECT id, name, price FROM products WHERE name = $1 LIMIT 1`, fmt.Sprintf("product%d", rand.Intn(productCount))).Scan(&id, &name, &price)
-		if err != nil {
-			return Simulation{
-				Read1: statsRead1,
-			}, err
-		}
-		latenciesRead2 = append(latenciesRead2, time.Since(start))
+	var plans []struct {
+		PlanningTime  float64 `json:"Planning Time"`
+		ExecutionTime float64 `json:"Execution Time"`
 	}
-	statsRead2, err := calculateLatencyStatsNs(latenciesRead2)
+	err = json.Unmarshal(raw, &plans)
 	if err != nil {
-		return Simulation{
-			Read1: statsRead1,
-			Read2: statsRead2,
-		}, err
+		return 0, err
+	}
+	if len(plans) == 0 {
+		return 0, fmt.Errorf("empty EXPLAIN output for query: %s", query)
 	}
 
-	// add 100 new products and measure the latency
-	latenciesWrite1 := []time.Duration{}
-	for i := 0; i < queryCount; i++ {
-		start := time.Now()
-		_, err = db.Exec(`INSERT INTO products (name, price) VALUES ($1, $2)`, fmt.Sprintf("product%d", i), rand.Float64()*100)
-		if err != nil {
-			return Simulation{
-				Read1: statsRead1,
-				Read2: statsRead2,
-			}, err
-		}
-		latenciesWrite1 = append(latenciesWrite1, time.Since(start))
+	// both timings are reported in milliseconds
+	ms := plans[0].PlanningTime + plans[0].ExecutionTime
+	return time.Duration(ms * float64(time.Millisecond)), nil
+}
+
+// Adds the median server-side time and the estimated network overhead to
+// the given stats. If no server times were sampled the stats are returned as is.
+func addServerLatency(latencyStats LatencyStats, serverTimes []time.Duration) (LatencyStats, error) {
+	if len(serverTimes) == 0 {
+		return latencyStats, nil
 	}
-	statsWrite1, err := calculateLatencyStatsNs(latenciesWrite1)
+
+	durations := make([]float64, len(serverTimes))
+	for i, d := range serverTimes {
+		durations[i] = float64(d.Nanoseconds())
+	}
+
+	serverLatency, err := stats.Median(stats.Float64Data(durations))
 	if err != nil {
-		return Simulation{
-			Read1:  statsRead1,
-			Read2:  statsRead2,
-			Write1: statsWrite1,
-		}, err
+		return latencyStats, err
 	}
 
-	return Simulation{
-		Read1:  statsRead1,
-		Read2:  statsRead2,
-		Write1: statsWrite1,
-	}, nil
+	latencyStats.ServerLatency = serverLatency
+	latencyStats.NetworkLatency = max(latencyStats.MedianLatency-serverLatency, 0)
+	return latencyStats, nil
 }
 
 func calculateLatencyStatsNs(latencies []time.Duration) (LatencyStats, error) {
@@ -569,24 +914,66 @@ func calculateLatencyStatsNs(latencies []time.Duration) (LatencyStats, error) {
 }
 
 type LatencyLog struct {
-	Label         string    `db:"label"`
-	MedianLatency float64   `db:"median_latency"`
-	P10Latency    float64   `db:"p10_latency"`
-	P25Latency    float64   `db:"p25_latency"`
-	P75Latency    float64   `db:"p75_latency"`
-	P90Latency    float64   `db:"p90_latency"`
-	P95Latency    float64   `db:"p95_latency"`
-	Count         float64   `db:"count"`
-	CreatedAt     time.Time `db:"created_at"`
-	UpdatedAt     time.Time `db:"updated_at"`
+	Label           string    `db:"label"`
+	RunID           int64     `db:"run_id"`
+	Scenario        string    `db:"scenario"`
+	Workload        string    `db:"workload"`
+	KeyDistribution string    `db:"key_distribution"`
+	MedianLatency   float64   `db:"median_latency"`
+	P10Latency      float64   `db:"p10_latency"`
+	P25Latency      float64   `db:"p25_latency"`
+	P75Latency      float64   `db:"p75_latency"`
+	P90Latency      float64   `db:"p90_latency"`
+	P95Latency      float64   `db:"p95_latency"`
+	Count           float64   `db:"count"`
+	Retries         float64   `db:"retries"`
+	RowsPerSecond   float64   `db:"rows_per_sec"`
+	PerQueryLatency float64   `db:"per_query_latency"`
+	ServerLatency   float64   `db:"server_latency"`
+	NetworkLatency  float64   `db:"network_latency"`
+	BaselineRatio   float64   `db:"baseline_ratio"`
+	CacheHits       float64   `db:"cache_hits"`
+	CacheMisses     float64   `db:"cache_misses"`
+	CreatedAt       time.Time `db:"created_at"`
+	UpdatedAt       time.Time `db:"updated_at"`
+}
+
+// Returns the share of the median latency spent on the server, in percent.
+// Used to render the server vs network breakdown.
+func (l LatencyLog) ServerShare() float64 {
+	if l.MedianLatency <= 0 {
+		return 0
+	}
+	return min(l.ServerLatency/l.MedianLatency*100, 100)
+}
+
+// Returns the share of cache reads that hit, in percent, or -1 for workloads
+// that don't read through a cache.
+func (l LatencyLog) CacheHitRate() float64 {
+	reads := l.CacheHits + l.CacheMisses
+	if reads <= 0 {
+		return -1
+	}
+	return l.CacheHits / reads * 100
 }
 
 // Logs the latency stats to the database.
-func logLatency(db *sqlx.Tx, label string, latency LatencyStats) error {
+// The baseline is the median latency of the scenario's baseline probe; it's
+// stored as a ratio so each workload can be read as "N× baseline RTT". The
+// history is recorded with its fingerprint, see historyFingerprint.
+func logLatency(db *sqlx.Tx, runID int64, scenario string, workload WorkloadResult, baseline float64, fingerprint string) error {
+	latency := workload.Stats
+	var baselineRatio float64
+	if baseline > 0 {
+		baselineRatio = latency.MedianLatency / baseline
+	}
+
 	_, err := db.NamedExec(`
-		INSERT INTO latency_logs (label, median_latency, p10_latency, p25_latency, p75_latency, p90_latency, p95_latency, count, created_at, updated_at) 
-		VALUES (:label, :median_latency, :p10_latency, :p25_latency, :p75_latency, :p90_latency, :p95_latency, :count, CURRENT_TIMESTAMP, CURRENT_TIMESTAMP)
+		INSERT INTO latency_logs (label, run_id, scenario, workload, key_distribution, median_latency, p10_latency, p25_latency, p75_latency, p90_latency, p95_latency, count, retries, rows_per_sec, per_query_latency, server_latency, network_latency, baseline_ratio, cache_hits, cache_misses, created_at, updated_at) 
+		VALUES (:label, :run_id, :scenario, :workload, :key_distribution, :median_latency, :p10_latency, :p25_latency, :p75_latency, :p90_latency, :p95_latency, :count, :retries, :rows_per_sec, :per_query_latency, :server_latency, :network_latency, :baseline_ratio, :cache_hits, :cache_misses, CURRENT_TIMESTAMP, CURRENT_TIMESTAMP)
 		ON CONFLICT (label) DO UPDATE SET
+			run_id = :run_id,
+			key_distribution = :key_distribution,
 			median_latency = :median_latency,
 			p10_latency = :p10_latency,
 			p25_latency = :p25_latency,
@@ -594,17 +981,40 @@ func logLatency(db *sqlx.Tx, label string, latency LatencyStats) error {
 			p90_latency = :p90_latency,
 			p95_latency = :p95_latency,
 			count = :count,
+			retries = :retries,
+			rows_per_sec = :rows_per_sec,
+			per_query_latency = :per_query_latency,
+			server_latency = :server_latency,
+			network_latency = :network_latency,
+			baseline_ratio = :baseline_ratio,
+			cache_hits = :cache_hits,
+			cache_misses = :cache_misses,
 			created_at = CURRENT_TIMESTAMP,
 			updated_at = CURRENT_TIMESTAMP
 		`, LatencyLog{
-		Label:         label,
-		MedianLatency: latency.MedianLatency,
-		P10Latency:    latency.P10Latency,
-		P25Latency:    latency.P25Latency,
-		P75Latency:    latency.P75Latency,
-		P90Latency:    latency.P90Latency,
-		P95Latency:    latency.P95Latency,
-		Count:         latency.Count,
+		Label:           scenario + " " + workload.Name,
+		RunID:           runID,
+		Scenario:        scenario,
+		Workload:        workload.Name,
+		KeyDistribution: string(workload.KeyDistribution),
+		MedianLatency:   latency.MedianLatency,
+		P10Latency:      latency.P10Latency,
+		P25Latency:      latency.P25Latency,
+		P75Latency:      latency.P75Latency,
+		P90Latency:      latency.P90Latency,
+		P95Latency:      latency.P95Latency,
+		Count:           latency.Count,
+		Retries:         latency.Retries,
+		RowsPerSecond:   latency.RowsPerSecond,
+		PerQueryLatency: latency.PerQueryLatency,
+		ServerLatency:   latency.ServerLatency,
+		NetworkLatency:  latency.NetworkLatency,
+		BaselineRatio:   baselineRatio,
+		CacheHits:       latency.CacheHits,
+		CacheMisses:     latency.CacheMisses,
 	})
-	return err
+	if err != nil {
+		return err
+	}
+	return recordHistory(db, runID, scenario+" "+workload.Name, fingerprint, latency)
 }
@@ -0,0 +1,69 @@
+package latency_simulations
+
+import (
+	"math"
+	"strings"
+	"testing"
+)
+
+// A run that fails returns its error and is recorded as failed, instead of
+// panicking, so callers outside the queue don't need to recover.
+func TestRunSimulationsRecordsFailedRuns(t *testing.T) {
+	opts := newSimulationOptions()
+	opts.Seed = 1
+	opts.ZipfianSkew = 0.5 // invalid, the run fails before touching any db
+
+	runID, err := runSimulations(opts, nil)
+	if err == nil {
+		t.Fatal("runSimulations() succeeded with an invalid skew")
+	}
+	if runID == 0 {
+		t.Fatal("runSimulations() didn't record the failed run")
+	}
+	run, err := runByID(int(runID))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if run == nil || !strings.Contains(run.Error, "skew") {
+		t.Errorf("recorded run = %+v, want its error to mention the skew", run)
+	}
+}
+
+// Workloads measure at least 10 queries, the fewest the P10 needs.
+func TestSetDefaultsClampsQueries(t *testing.T) {
+	for _, tt := range []struct{ queries, want int }{
+		{0, defaultQueryCount},
+		{1, minQueryCount},
+		{50, 50},
+		{1_000_000, maxQueryCount},
+	} {
+		opts := newSimulationOptions()
+		opts.Queries = tt.queries
+		opts.setDefaults()
+		if opts.Queries != tt.want {
+			t.Errorf("setDefaults() with %d queries = %d, want %d", tt.queries, opts.Queries, tt.want)
+		}
+	}
+}
+
+func TestValidateZipfianSkew(t *testing.T) {
+	for _, tt := range []struct {
+		skew  float64
+		valid bool
+	}{
+		{0, true}, // the default is set later
+		{1.1, true},
+		{1, false},
+		{-2, false},
+		{math.NaN(), false},
+		{math.Inf(1), false},
+		{math.Inf(-1), false},
+	} {
+		opts := newSimulationOptions()
+		opts.ZipfianSkew = tt.skew
+		err := opts.validate()
+		if (err == nil) != tt.valid {
+			t.Errorf("validate() with skew %g = %v, want valid %v", tt.skew, err, tt.valid)
+		}
+	}
+}
@@ -6,11 +6,9 @@ var db *sqlx.DB
 
 func initDB() error {
 	var err error
-	db, err = sqlx.Open("sqlite3", "./db/latency_simulations.sqlite?_journal_mode=WAL&_synchronous=NORMAL&_busy_timeout=5000&_cache_size=-2000")
-	if err != nil {
-		return err
-	}
-	_, err = db.Exec("PRAGMA foreign_keys = ON")
+	// foreign keys are enforced per connection, so they're turned on in the
+	// DSN for every connection of the pool rather than with a PRAGMA
+	db, err = sqlx.Open("sqlite3", "./db/latency_simulations.sqlite?_journal_mode=WAL&_synchronous=NORMAL&_busy_timeout=5000&_cache_size=-2000&_foreign_keys=1")
 	if err != nil {
 		return err
 	}
@@ -30,5 +28,43 @@ func initDB() error {
 	if err != nil {
 		return err
 	}
-	return nil
+	err = createRunsTable(db)
+	if err != nil {
+		return err
+	}
+	err = createScenariosTable(db)
+	if err != nil {
+		return err
+	}
+	err = createSchedulesTables(db)
+	if err != nil {
+		return err
+	}
+	err = createAnomaliesTables(db)
+	if err != nil {
+		return err
+	}
+	return createWebhooksTables(db)
+}
+
+// Drops a column from a table created before the column was removed.
+func dropColumn(db sqlx.Ext, table, column string) error {
+	var exists bool
+	err := sqlx.Get(db, &exists, `SELECT COUNT(*) > 0 FROM pragma_table_info(?) WHERE name = ?`, table, column)
+	if err != nil || !exists {
+		return err
+	}
+	_, err = db.Exec(`ALTER TABLE ` + table + ` DROP COLUMN ` + column)
+	return err
+}
+
+// Adds a column to a table created before the column existed.
+func addMissingColumn(db sqlx.Ext, table, column, definition string) error {
+	var exists bool
+	err := sqlx.Get(db, &exists, `SELECT COUNT(*) > 0 FROM pragma_table_info(?) WHERE name = ?`, table, column)
+	if err != nil || exists {
+		return err
+	}
+	_, err = db.Exec(`ALTER TABLE ` + table + ` ADD COLUMN ` + column + ` ` + definition)
+	return err
 }
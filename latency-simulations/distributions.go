@@ -0,0 +1,106 @@
+package latency_simulations
+
+import (
+	"fmt"
+	"math/rand"
+	"strings"
+)
+
+// Key distributions decide which product a keyed workload (Read2, the
+// caches, the pipelines, ...) looks up next. Uniform keys make the database's
+// buffer cache look worse than it is in most apps, while real traffic tends to
+// concentrate on a few hot keys, so the distribution can be picked per run and
+// overridden per workload.
+
+type KeyDistribution string
+
+const (
+	// Every product is equally likely.
+	Uniform KeyDistribution = "uniform"
+
+	// A few products get most of the lookups, like popular items in a shop.
+	// How skewed it is depends on the zipfian_skew option.
+	Zipfian KeyDistribution = "zipfian"
+
+	// hotspot_ops percent of the lookups go to the first hotspot_keys
+	// percent of the products, the rest to the other products.
+	Hotspot KeyDistribution = "hotspot"
+
+	// Like zipfian, but the most recently inserted products are the hot ones.
+	Latest KeyDistribution = "latest"
+
+	// Products are looked up one after the other, wrapping around.
+	Sequential KeyDistribution = "sequential"
+)
+
+var keyDistributions = []KeyDistribution{Uniform, Zipfian, Hotspot, Latest, Sequential}
+
+const (
+	defaultZipfianSkew = 1.1
+	defaultHotspotOps  = 80 // percent
+	defaultHotspotKeys = 20 // percent
+)
+
+func parseKeyDistribution(s string) (KeyDistribution, error) {
+	if s == "" {
+		return Uniform, nil
+	}
+	for _, d := range keyDistributions {
+		if strings.EqualFold(s, string(d)) {
+			return d, nil
+		}
+	}
+	return "", fmt.Errorf("unknown key distribution %q", s)
+}
+
+// Parses per workload distributions, e.g. "Read2=zipfian,LocalCache=hotspot".
+func parseWorkloadDistributions(s string) (map[string]KeyDistribution, error) {
+	result := map[string]KeyDistribution{}
+	for _, pair := range strings.Split(s, ",") {
+		pair = strings.TrimSpace(pair)
+		if pair == "" {
+			continue
+		}
+		name, value, ok := strings.Cut(pair, "=")
+		if !ok {
+			return nil, fmt.Errorf("invalid workload distribution %q, expected workload=distribution", pair)
+		}
+		d, err := parseKeyDistribution(strings.TrimSpace(value))
+		if err != nil {
+			return nil, err
+		}
+		result[strings.TrimSpace(name)] = d
+	}
+	return result, nil
+}
+
+// Returns a function that picks keys from 0 to n-1 with the given distribution,
+// using the given random source. Pickers aren't safe for concurrent use, as
+// workloads run sequentially.
+func newKeyPicker(d KeyDistribution, n int, opts SimulationOptions, r *rand.Rand) func() int {
+	switch d {
+	case Zipfian:
+		zipf := rand.NewZipf(r, opts.ZipfianSkew, 1, uint64(n-1))
+		return func() int { return int(zipf.Uint64()) }
+	case Latest:
+		zipf := rand.NewZipf(r, opts.ZipfianSkew, 1, uint64(n-1))
+		return func() int { return n - 1 - int(zipf.Uint64()) }
+	case Hotspot:
+		hotKeys := max(n*opts.HotspotKeys/100, 1)
+		return func() int {
+			if hotKeys == n || r.Intn(100) < opts.HotspotOps {
+				return r.Intn(hotKeys)
+			}
+			return hotKeys + r.Intn(n-hotKeys)
+		}
+	case Sequential:
+		next := 0
+		return func() int {
+			key := next
+			next = (next + 1) % n
+			return key
+		}
+	default:
+		return func() int { return r.Intn(n) }
+	}
+}
@@ -0,0 +1,148 @@
+package latency_simulations
+
+import (
+	"math/rand"
+	"testing"
+)
+
+func TestParseKeyDistribution(t *testing.T) {
+	tests := []struct {
+		input   string
+		want    KeyDistribution
+		wantErr bool
+	}{
+		{"", Uniform, false},
+		{"uniform", Uniform, false},
+		{"Zipfian", Zipfian, false},
+		{"HOTSPOT", Hotspot, false},
+		{"latest", Latest, false},
+		{"sequential", Sequential, false},
+		{"gaussian", "", true},
+	}
+	for _, tt := range tests {
+		got, err := parseKeyDistribution(tt.input)
+		if (err != nil) != tt.wantErr {
+			t.Errorf("parseKeyDistribution(%q) error = %v, wantErr %v", tt.input, err, tt.wantErr)
+			continue
+		}
+		if got != tt.want {
+			t.Errorf("parseKeyDistribution(%q) = %q, want %q", tt.input, got, tt.want)
+		}
+	}
+}
+
+func TestParseWorkloadDistributions(t *testing.T) {
+	tests := []struct {
+		input   string
+		want    map[string]KeyDistribution
+		wantErr bool
+	}{
+		{"", map[string]KeyDistribution{}, false},
+		{"Read2=zipfian", map[string]KeyDistribution{"Read2": Zipfian}, false},
+		{" Read2 = zipfian , LocalCache=hotspot,", map[string]KeyDistribution{"Read2": Zipfian, "LocalCache": Hotspot}, false},
+		{"Read2", nil, true},
+		{"Read2=gaussian", nil, true},
+	}
+	for _, tt := range tests {
+		got, err := parseWorkloadDistributions(tt.input)
+		if (err != nil) != tt.wantErr {
+			t.Errorf("parseWorkloadDistributions(%q) error = %v, wantErr %v", tt.input, err, tt.wantErr)
+			continue
+		}
+		if len(got) != len(tt.want) {
+			t.Errorf("parseWorkloadDistributions(%q) = %v, want %v", tt.input, got, tt.want)
+			continue
+		}
+		for name, d := range tt.want {
+			if got[name] != d {
+				t.Errorf("parseWorkloadDistributions(%q)[%s] = %q, want %q", tt.input, name, got[name], d)
+			}
+		}
+	}
+}
+
+func TestNewKeyPicker(t *testing.T) {
+	const n = 1_000
+	const picks = 20_000
+	opts := SimulationOptions{ZipfianSkew: defaultZipfianSkew, HotspotOps: defaultHotspotOps, HotspotKeys: defaultHotspotKeys}
+
+	tests := []struct {
+		distribution KeyDistribution
+		// checks how often each key was picked
+		check func(t *testing.T, counts []int)
+	}{
+		{Uniform, func(t *testing.T, counts []int) {
+			// every key is expected 20 times, none should be far off
+			for key, count := range counts {
+				if count == 0 || count > 60 {
+					t.Errorf("key %d picked %d times, expected around %d", key, count, picks/n)
+				}
+			}
+		}},
+		{Zipfian, func(t *testing.T, counts []int) {
+			if counts[0] < picks/10 || counts[0] < 10*counts[n/2] {
+				t.Errorf("key 0 picked %d times and key %d %d times, expected the first keys to be hot", counts[0], n/2, counts[n/2])
+			}
+		}},
+		{Latest, func(t *testing.T, counts []int) {
+			if counts[n-1] < picks/10 || counts[n-1] < 10*counts[n/2] {
+				t.Errorf("key %d picked %d times and key %d %d times, expected the last keys to be hot", n-1, counts[n-1], n/2, counts[n/2])
+			}
+		}},
+		{Hotspot, func(t *testing.T, counts []int) {
+			hot := 0
+			for _, count := range counts[:n*defaultHotspotKeys/100] {
+				hot += count
+			}
+			share := hot * 100 / picks
+			if share < defaultHotspotOps-3 || share > defaultHotspotOps+3 {
+				t.Errorf("%d%% of the picks went to the hot keys, expected %d%%", share, defaultHotspotOps)
+			}
+		}},
+		{Sequential, func(t *testing.T, counts []int) {
+			for key, count := range counts {
+				if count != picks/n {
+					t.Errorf("key %d picked %d times, expected exactly %d", key, count, picks/n)
+				}
+			}
+		}},
+	}
+	for _, tt := range tests {
+		t.Run(string(tt.distribution), func(t *testing.T) {
+			pick := newKeyPicker(tt.distribution, n, opts, rand.New(rand.NewSource(1)))
+			counts := make([]int, n)
+			for i := 0; i < picks; i++ {
+				key := pick()
+				if key < 0 || key >= n {
+					t.Fatalf("picked key %d, out of [0, %d)", key, n)
+				}
+				counts[key]++
+			}
+			tt.check(t, counts)
+		})
+	}
+}
+
+func TestNewKeyPickerIsDeterministic(t *testing.T) {
+	opts := SimulationOptions{ZipfianSkew: defaultZipfianSkew, HotspotOps: defaultHotspotOps, HotspotKeys: defaultHotspotKeys}
+	for _, d := range keyDistributions {
+		first := newKeyPicker(d, 100, opts, rand.New(rand.NewSource(42)))
+		second := newKeyPicker(d, 100, opts, rand.New(rand.NewSource(42)))
+		for i := 0; i < 100; i++ {
+			if a, b := first(), second(); a != b {
+				t.Errorf("%s: pick %d differs between pickers with the same seed: %d != %d", d, i, a, b)
+				break
+			}
+		}
+	}
+}
+
+func TestSequentialKeyPickerWrapsAround(t *testing.T) {
+	pick := newKeyPicker(Sequential, 3, SimulationOptions{}, rand.New(rand.NewSource(1)))
+	want := []int{0, 1, 2, 0, 1}
+	for i, w := range want {
+		if got := pick(); got != w {
+			t.Errorf("pick %d = %d, want %d", i, got, w)
+		}
+	}
+}
@@ -0,0 +1,131 @@
+package latency_simulations
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"log"
+
+	"github.com/jmoiron/sqlx"
+	"go.opentelemetry.io/otel/attribute"
+)
+
+// Seeding row by row takes far longer than the measurements over long links,
+// so the seeded dataset is kept between runs. Each target db records the
+// fingerprint of the dataset it holds, and a run reuses the dataset when the
+// fingerprint and the row counts match what the run would seed. Rows the
+// workloads add are deleted after each run and the prices the transaction
+// workloads update are set back to the seeded ones, so the dataset stays
+// reusable.
+
+// Bump when the tables or the seeded data change shape, so existing
+// datasets are re-seeded.
+const fixtureVersion = 2
+
+// Describes the dataset a run seeds.
+func fixtureFingerprint(opts SimulationOptions) string {
+	return fmt.Sprintf("v%d/products=%d/reviews=%d/payload=%d/seed=%d", fixtureVersion, opts.Products, opts.ReviewsPerProduct, opts.PayloadSize, opts.Seed)
+}
+
+// Makes sure the db holds the dataset of the options, re-seeding it unless
+// the existing one matches or the options ask for a reset. Traced as the
+// setup of the scenario, with the seeding in its own span.
+func prepareDataset(ctx context.Context, db *sqlx.DB, opts SimulationOptions, createTables func(db *sqlx.DB) error) (err error) {
+	fingerprint := fixtureFingerprint(opts)
+	ctx, span := startSpan(ctx, "setup", attribute.String("simulation.dataset", fingerprint))
+	defer func() { endSpan(span, err) }()
+
+	_, err = db.Exec(`CREATE TABLE IF NOT EXISTS latency_fixtures (fingerprint TEXT NOT NULL)`)
+	if err != nil {
+		return err
+	}
+
+	if !opts.ResetDataset {
+		matches, err := datasetMatches(db, opts, fingerprint)
+		if err != nil {
+			return err
+		}
+		span.SetAttributes(attribute.Bool("simulation.dataset_reused", matches))
+		if matches {
+			log.Printf("Reusing dataset %s", fingerprint)
+			return nil
+		}
+	}
+
+	log.Printf("Seeding dataset %s", fingerprint)
+
+	// drop tables if they exist; ensures a clean slate
+	_, err = db.Exec(`DROP TABLE IF EXISTS product_reviews`)
+	if err != nil {
+		return err
+	}
+	_, err = db.Exec(`DROP TABLE IF EXISTS products`)
+	if err != nil {
+		return err
+	}
+	_, err = db.Exec(`DELETE FROM latency_fixtures`)
+	if err != nil {
+		return err
+	}
+
+	err = createTables(db)
+	if err != nil {
+		return err
+	}
+	_, seedSpan := startSpan(ctx, "seed",
+		attribute.Int("simulation.products", opts.Products),
+		attribute.Int("simulation.reviews_per_product", opts.ReviewsPerProduct),
+	)
+	err = seed(db, opts)
+	endSpan(seedSpan, err)
+	if err != nil {
+		return err
+	}
+
+	// recorded last, so a failed seed is never reused
+	_, err = db.Exec(db.Rebind(`INSERT INTO latency_fixtures (fingerprint) VALUES (?)`), fingerprint)
+	return err
+}
+
+// Checks the recorded fingerprint and that no rows are missing or left over.
+func datasetMatches(db *sqlx.DB, opts SimulationOptions, fingerprint string) (bool, error) {
+	var recorded string
+	err := db.Get(&recorded, `SELECT fingerprint FROM latency_fixtures LIMIT 1`)
+	if err == sql.ErrNoRows {
+		return false, nil
+	}
+	if err != nil {
+		return false, err
+	}
+	if recorded != fingerprint {
+		return false, nil
+	}
+
+	var counts struct {
+		Products int `db:"products"`
+		Reviews  int `db:"reviews"`
+	}
+	err = db.Get(&counts, `SELECT (SELECT COUNT(*) FROM products) AS products, (SELECT COUNT(*) FROM product_reviews) AS reviews`)
+	if err != nil {
+		// e.g. the tables were dropped by hand, re-seeding recreates them
+		log.Printf("Can't count the rows of dataset %s: %v", fingerprint, err)
+		return false, nil
+	}
+	return counts.Products == opts.Products && counts.Reviews == opts.Products*opts.ReviewsPerProduct, nil
+}
+
+// Deletes the rows the workloads added on top of the seeded ones, and sets
+// the prices back to the seeded ones. Seeded rows get the lowest ids, as
+// they are inserted first into fresh tables.
+func restoreDataset(db *sqlx.DB, opts SimulationOptions) error {
+	_, err := db.Exec(db.Rebind(`DELETE FROM product_reviews WHERE id > ?`), opts.Products*opts.ReviewsPerProduct)
+	if err != nil {
+		return err
+	}
+	_, err = db.Exec(db.Rebind(`DELETE FROM products WHERE id > ?`), opts.Products)
+	if err != nil {
+		return err
+	}
+	_, err = db.Exec(`UPDATE products SET price = seeded_price WHERE price <> seeded_price`)
+	return err
+}
@@ -0,0 +1,117 @@
+package latency_simulations
+
+import (
+	"context"
+	"testing"
+
+	"github.com/jmoiron/sqlx"
+)
+
+// Marks the dataset, so a test can tell whether it was re-seeded.
+func markDataset(t *testing.T, db *sqlx.DB) {
+	t.Helper()
+	_, err := db.Exec(`UPDATE products SET name = 'marked' WHERE id = 1`)
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+func datasetMarked(t *testing.T, db *sqlx.DB) bool {
+	t.Helper()
+	var name string
+	err := db.Get(&name, `SELECT name FROM products WHERE id = 1`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return name == "marked"
+}
+
+func TestPrepareDataset(t *testing.T) {
+	db := openTestSQLite(t)
+	opts := testSimulationOptions(t)
+	prepare := func(opts SimulationOptions) {
+		t.Helper()
+		err := prepareDataset(context.Background(), db, opts, createSQLiteTables)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	prepare(opts)
+	markDataset(t, db)
+	prepare(opts)
+	if !datasetMarked(t, db) {
+		t.Errorf("a matching dataset was re-seeded")
+	}
+
+	for _, tt := range []struct {
+		name   string
+		change func(opts *SimulationOptions)
+	}{
+		{"seed", func(opts *SimulationOptions) { opts.Seed++ }},
+		{"products", func(opts *SimulationOptions) { opts.Products++ }},
+		{"reviews", func(opts *SimulationOptions) { opts.ReviewsPerProduct++ }},
+		{"payload", func(opts *SimulationOptions) { opts.PayloadSize = 100 }},
+		{"reset", func(opts *SimulationOptions) { opts.ResetDataset = true }},
+	} {
+		changed := opts
+		tt.change(&changed)
+		markDataset(t, db)
+		prepare(changed)
+		if datasetMarked(t, db) {
+			t.Errorf("the dataset was reused after changing the %s", tt.name)
+		}
+	}
+
+	prepare(opts)
+	markDataset(t, db)
+	_, err := db.Exec(`INSERT INTO products (name, price) VALUES ('left over', 1)`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	prepare(opts)
+	if datasetMarked(t, db) {
+		t.Errorf("a dataset with a left over row was reused")
+	}
+}
+
+// The rows and prices the workloads change are set back after a run.
+func TestRestoreDataset(t *testing.T) {
+	db := openTestSQLite(t)
+	opts := testSimulationOptions(t)
+	err := prepareDataset(context.Background(), db, opts, createSQLiteTables)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	_, err = db.Exec(`INSERT INTO products (name, price) VALUES ('added', 1)`)
+	if err == nil {
+		_, err = db.Exec(`INSERT INTO product_reviews (product_id, review) VALUES (1, 'added')`)
+	}
+	if err == nil {
+		_, err = db.Exec(`UPDATE products SET price = price * 2 WHERE id <= 10`)
+	}
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = restoreDataset(db, opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	matches, err := datasetMatches(db, opts, fixtureFingerprint(opts))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !matches {
+		t.Errorf("the restored dataset doesn't match")
+	}
+	var changedPrices int
+	err = db.Get(&changedPrices, `SELECT COUNT(*) FROM products WHERE price <> seeded_price`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if changedPrices != 0 {
+		t.Errorf("%d prices weren't restored", changedPrices)
+	}
+}
@@ -0,0 +1,96 @@
+package latency_simulations
+
+import (
+	"container/list"
+	"time"
+)
+
+// The local cache workload reads products through a bounded LRU cache in the
+// Go process, falling through to the database (Read2) on a miss. Which
+// products are read follows the workload's key distribution, so with a uniform
+// distribution most reads miss and with a zipfian one most of them hit.
+// Hits and misses are counted, and stored with the results.
+
+const (
+	localCacheTTL = time.Minute
+)
+
+type lruEntry[V any] struct {
+	key       string
+	value     V
+	expiresAt time.Time
+}
+
+// A bounded LRU cache whose entries also expire after a TTL.
+// It isn't safe for concurrent use, as workloads run sequentially.
+type lruCache[V any] struct {
+	size    int
+	ttl     time.Duration
+	order   *list.List // most recently used first
+	entries map[string]*list.Element
+}
+
+func newLRUCache[V any](size int, ttl time.Duration) *lruCache[V] {
+	return &lruCache[V]{size: size, ttl: ttl, order: list.New(), entries: map[string]*list.Element{}}
+}
+
+func (c *lruCache[V]) get(key string) (V, bool) {
+	var zero V
+	element, ok := c.entries[key]
+	if !ok {
+		return zero, false
+	}
+	entry := element.Value.(*lruEntry[V])
+	if time.Now().After(entry.expiresAt) {
+		c.order.Remove(element)
+		delete(c.entries, key)
+		return zero, false
+	}
+	c.order.MoveToFront(element)
+	return entry.value, true
+}
+
+func (c *lruCache[V]) set(key string, value V) {
+	expiresAt := time.Now().Add(c.ttl)
+	if element, ok := c.entries[key]; ok {
+		entry := element.Value.(*lruEntry[V])
+		entry.value, entry.expiresAt = value, expiresAt
+		c.order.MoveToFront(element)
+		return
+	}
+
+	c.entries[key] = c.order.PushFront(&lruEntry[V]{key: key, value: value, expiresAt: expiresAt})
+	if c.order.Len() > c.size {
+		oldest := c.order.Back()
+		c.order.Remove(oldest)
+		delete(c.entries, oldest.Value.(*lruEntry[V]).key)
+	}
+}
+
+// The cache starts empty for every target, so each scenario warms it up
+// with its own first reads.
+// It holds a tenth of the seeded products.
+func localCacheWorkloads(t *target) []workload {
+	return []workload{
+		{name: "LocalCache", run: localCacheRead(max(t.products/10, 1)), keyed: true},
+	}
+}
+
+func localCacheRead(size int) func(t *target, i int) error {
+	cache := newLRUCache[product](size, localCacheTTL)
+	return func(t *target, i int) error {
+		name := t.randomProductName()
+		if _, ok := cache.get(name); ok {
+			t.cacheHits++
+			return nil
+		}
+		t.cacheMisses++
+
+		p, err := queryOne[product](t, read2Query, name)
+		if err != nil {
+			return err
+		}
+		cache.set(name, p)
+		return nil
+	}
+}
@@ -0,0 +1,85 @@
+package latency_simulations
+
+import (
+	"testing"
+	"time"
+)
+
+func TestLRUCache(t *testing.T) {
+	type step struct {
+		op    string // "get" or "set"
+		key   string
+		value int
+		hit   bool // for gets
+	}
+	tests := []struct {
+		name  string
+		size  int
+		steps []step
+	}{
+		{"miss on an empty cache", 2, []step{
+			{op: "get", key: "a"},
+		}},
+		{"hit after set", 2, []step{
+			{op: "set", key: "a", value: 1},
+			{op: "get", key: "a", value: 1, hit: true},
+		}},
+		{"set replaces the value", 2, []step{
+			{op: "set", key: "a", value: 1},
+			{op: "set", key: "a", value: 2},
+			{op: "get", key: "a", value: 2, hit: true},
+		}},
+		{"evicts the least recently set", 2, []step{
+			{op: "set", key: "a", value: 1},
+			{op: "set", key: "b", value: 2},
+			{op: "set", key: "c", value: 3},
+			{op: "get", key: "a"},
+			{op: "get", key: "b", value: 2, hit: true},
+			{op: "get", key: "c", value: 3, hit: true},
+		}},
+		{"a get makes the key recently used", 2, []step{
+			{op: "set", key: "a", value: 1},
+			{op: "set", key: "b", value: 2},
+			{op: "get", key: "a", value: 1, hit: true},
+			{op: "set", key: "c", value: 3},
+			{op: "get", key: "a", value: 1, hit: true},
+			{op: "get", key: "b"},
+		}},
+		{"updating a key doesn't evict", 2, []step{
+			{op: "set", key: "a", value: 1},
+			{op: "set", key: "b", value: 2},
+			{op: "set", key: "a", value: 3},
+			{op: "get", key: "a", value: 3, hit: true},
+			{op: "get", key: "b", value: 2, hit: true},
+		}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cache := newLRUCache[int](tt.size, time.Minute)
+			for i, s := range tt.steps {
+				if s.op == "set" {
+					cache.set(s.key, s.value)
+					continue
+				}
+				value, hit := cache.get(s.key)
+				if hit != s.hit || value != s.value {
+					t.Errorf("step %d: get(%q) = %d, %v, want %d, %v", i, s.key, value, hit, s.value, s.hit)
+				}
+			}
+			if cache.order.Len() > tt.size || len(cache.entries) != cache.order.Len() {
+				t.Errorf("cache holds %d entries in its list and %d in its map, size %d", cache.order.Len(), len(cache.entries), tt.size)
+			}
+		})
+	}
+}
+
+func TestLRUCacheExpiry(t *testing.T) {
+	cache := newLRUCache[int](2, -time.Second) // entries are expired right away
+	cache.set("a", 1)
+	if _, hit := cache.get("a"); hit {
+		t.Errorf("get of an expired entry hit")
+	}
+	if len(cache.entries) != 0 || cache.order.Len() != 0 {
+		t.Errorf("expired entry wasn't removed")
+	}
+}
@@ -0,0 +1,145 @@
+package latency_simulations
+
+import (
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// Exports the latest results on /metrics (see common/metrics.go), so
+// Grafana can chart them next to everything else. Latency logs only keep
+// the percentiles of each label, not the raw samples, so they're exported
+// as gauges read from the db on every scrape, with a quantile label like a
+// Prometheus summary. Runs and errors are counted as they happen, so those
+// counters start over when the app restarts.
+
+const metricsNamespace = "latency_simulation"
+
+var (
+	runsTotal = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: metricsNamespace,
+		Name:      "runs_total",
+		Help:      "Simulation runs, by status: succeeded or failed.",
+	}, []string{"status"})
+
+	runDuration = prometheus.NewHistogram(prometheus.HistogramOpts{
+		Namespace: metricsNamespace,
+		Name:      "run_duration_seconds",
+		Help:      "How long simulation runs took, including setup & seeding.",
+		Buckets:   prometheus.ExponentialBuckets(1, 2, 12), // 1s to ~34m
+	})
+
+	errorsTotal = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: metricsNamespace,
+		Name:      "errors_total",
+		Help:      "Errors outside of the runs themselves, by source: webhook, notifier or summary.",
+	}, []string{"source"})
+)
+
+func init() {
+	prometheus.MustRegister(runsTotal, runDuration, errorsTotal, latencyCollector{})
+}
+
+// Records a completed run, see runSimulations.
+func observeRun(start time.Time, err error) {
+	status := "succeeded"
+	if err != nil {
+		status = "failed"
+	}
+	runsTotal.WithLabelValues(status).Inc()
+	runDuration.Observe(time.Since(start).Seconds())
+}
+
+var (
+	logLabels = []string{"label", "scenario", "workload", "key_distribution"}
+
+	latencyDesc = prometheus.NewDesc(metricsNamespace+"_latency_seconds",
+		"Latency percentiles of the latest run, by label.", append(logLabels, "quantile"), nil)
+	perQueryLatencyDesc = prometheus.NewDesc(metricsNamespace+"_per_query_latency_seconds",
+		"Median latency divided by the queries per operation, for workloads sending several at once.", logLabels, nil)
+	serverLatencyDesc = prometheus.NewDesc(metricsNamespace+"_server_latency_seconds",
+		"Median time spent on the server, when server timing is sampled.", logLabels, nil)
+	networkLatencyDesc = prometheus.NewDesc(metricsNamespace+"_network_latency_seconds",
+		"Median time spent on the network, when server timing is sampled.", logLabels, nil)
+	operationsDesc = prometheus.NewDesc(metricsNamespace+"_operations",
+		"Operations measured in the latest run, by label.", logLabels, nil)
+	retriesDesc = prometheus.NewDesc(metricsNamespace+"_retries",
+		"Operations retried after a serialization failure in the latest run, by label.", logLabels, nil)
+	rowsPerSecondDesc = prometheus.NewDesc(metricsNamespace+"_rows_per_second",
+		"Rows written per second, for workloads writing batches of rows.", logLabels, nil)
+	baselineRatioDesc = prometheus.NewDesc(metricsNamespace+"_baseline_ratio",
+		"Median latency relative to the scenario's own baseline: its TCPConnect median, or Select1 when there's none.", logLabels, nil)
+	lastRunDesc = prometheus.NewDesc(metricsNamespace+"_last_run_timestamp_seconds",
+		"When the latest run was recorded.", nil, nil)
+	lastRunIDDesc = prometheus.NewDesc(metricsNamespace+"_last_run_id",
+		"Id of the latest run, to find it on the results page.", nil, nil)
+)
+
+// Reads the latency logs on every scrape.
+type latencyCollector struct{}
+
+func (latencyCollector) Describe(ch chan<- *prometheus.Desc) {
+	for _, desc := range []*prometheus.Desc{
+		latencyDesc, perQueryLatencyDesc, serverLatencyDesc, networkLatencyDesc,
+		operationsDesc, retriesDesc, rowsPerSecondDesc, baselineRatioDesc, lastRunDesc, lastRunIDDesc,
+	} {
+		ch <- desc
+	}
+}
+
+func (latencyCollector) Collect(ch chan<- prometheus.Metric) {
+	run, err := latestRun()
+	if err != nil {
+		ch <- prometheus.NewInvalidMetric(lastRunDesc, err)
+		return
+	}
+	// the latency logs table is created by the first run
+	if run == nil {
+		return
+	}
+	ch <- prometheus.MustNewConstMetric(lastRunDesc, prometheus.GaugeValue, float64(run.CreatedAt.Unix()))
+	ch <- prometheus.MustNewConstMetric(lastRunIDDesc, prometheus.GaugeValue, float64(run.ID))
+
+	var logs []LatencyLog
+	err = db.Select(&logs, `SELECT * FROM latency_logs ORDER BY label`)
+	if err != nil {
+		ch <- prometheus.NewInvalidMetric(latencyDesc, err)
+		return
+	}
+	for _, l := range logs {
+		labels := []string{l.Label, l.Scenario, l.Workload, l.KeyDistribution}
+		for _, q := range []struct {
+			quantile string
+			value    float64
+		}{
+			{"0.1", l.P10Latency},
+			{"0.25", l.P25Latency},
+			{"0.5", l.MedianLatency},
+			{"0.75", l.P75Latency},
+			{"0.9", l.P90Latency},
+			{"0.95", l.P95Latency},
+		} {
+			ch <- prometheus.MustNewConstMetric(latencyDesc, prometheus.GaugeValue, seconds(q.value), append(labels, q.quantile)...)
+		}
+		ch <- prometheus.MustNewConstMetric(operationsDesc, prometheus.GaugeValue, l.Count, labels...)
+		ch <- prometheus.MustNewConstMetric(retriesDesc, prometheus.GaugeValue, l.Retries, labels...)
+		ch <- prometheus.MustNewConstMetric(baselineRatioDesc, prometheus.GaugeValue, l.BaselineRatio, labels...)
+
+		// only set for some workloads or options, see LatencyStats
+		if l.PerQueryLatency > 0 {
+			ch <- prometheus.MustNewConstMetric(perQueryLatencyDesc, prometheus.GaugeValue, seconds(l.PerQueryLatency), labels...)
+		}
+		if l.ServerLatency > 0 {
+			ch <- prometheus.MustNewConstMetric(serverLatencyDesc, prometheus.GaugeValue, seconds(l.ServerLatency), labels...)
+			ch <- prometheus.MustNewConstMetric(networkLatencyDesc, prometheus.GaugeValue, seconds(l.NetworkLatency), labels...)
+		}
+		if l.RowsPerSecond > 0 {
+			ch <- prometheus.MustNewConstMetric(rowsPerSecondDesc, prometheus.GaugeValue, l.RowsPerSecond, labels...)
+		}
+	}
+}
+
+// Latencies are stored in nanoseconds, Prometheus uses seconds.
+func seconds(nanoseconds float64) float64 {
+	return nanoseconds / float64(time.Second)
+}
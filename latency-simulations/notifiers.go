@@ -0,0 +1,152 @@
+package latency_simulations
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"go-on-rails/common"
+	"log"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// Alerts are sent through every configured notifier: they're always logged,
+// emailed as a digest to ALERT_EMAILS through the common mailer, and posted
+// as JSON to ALERT_WEBHOOK_URLS. Runs are also summarized by email to
+// RUN_SUMMARY_EMAILS. Locally, docker-compose runs mailpit and an echo server
+// as stand-ins for an SMTP server and a webhook receiver.
+
+type Notifier interface {
+	Name() string
+	Notify(alerts []Alert) error
+}
+
+const webhookTimeout = 10 * time.Second
+
+// Returns the notifiers configured with env variables.
+func configuredNotifiers() []Notifier {
+	notifiers := []Notifier{logNotifier{}}
+	emails := splitList(common.Env.ALERT_EMAILS)
+	if len(emails) > 0 {
+		notifiers = append(notifiers, emailNotifier{to: emails})
+	}
+	for _, url := range splitList(common.Env.ALERT_WEBHOOK_URLS) {
+		notifiers = append(notifiers, webhookNotifier{url: url, client: &http.Client{Timeout: webhookTimeout}})
+	}
+	return notifiers
+}
+
+// Sends the alerts through every notifier, logging the ones that fail.
+func notify(alerts []Alert) {
+	for _, notifier := range configuredNotifiers() {
+		err := notifier.Notify(alerts)
+		if err != nil {
+			log.Printf("Error notifying alerts through %s: %v", notifier.Name(), err)
+			errorsTotal.WithLabelValues("notifier").Inc()
+		}
+	}
+}
+
+type logNotifier struct{}
+
+func (logNotifier) Name() string { return "log" }
+
+func (logNotifier) Notify(alerts []Alert) error {
+	for _, alert := range alerts {
+		log.Printf("Latency alert: %s", alert)
+	}
+	return nil
+}
+
+type emailNotifier struct {
+	to []string
+}
+
+func (n emailNotifier) Name() string { return "email" }
+
+// Queues a single digest email listing the alerts of the run.
+func (n emailNotifier) Notify(alerts []Alert) error {
+	subject := fmt.Sprintf("Latency alert: %s", alerts[0].Label)
+	if len(alerts) > 1 {
+		subject = fmt.Sprintf("Latency alerts: %d labels jumped", len(alerts))
+	}
+
+	var text strings.Builder
+	fmt.Fprintf(&text, "Run #%d has latencies well beyond their recent history:\n\n", alerts[0].RunID)
+	for _, alert := range alerts {
+		fmt.Fprintf(&text, "- %s\n", alert)
+	}
+	fmt.Fprintf(&text, "\n%s\n", common.Env.BASE_URL)
+
+	html, err := common.RenderEmail(alert_digest_email(subject, alerts))
+	if err != nil {
+		return err
+	}
+	return common.QueueEmail(common.Email{To: n.to, Subject: subject, Text: text.String(), HTML: html})
+}
+
+// Queues a summary of the run to RUN_SUMMARY_EMAILS, if any. A failed run
+// has no results and its error is summarized instead. Errors are logged.
+func emailRunSummary(runID int64, runErr error) {
+	to := splitList(common.Env.RUN_SUMMARY_EMAILS)
+	if len(to) == 0 {
+		return
+	}
+
+	subject := fmt.Sprintf("Run #%d completed", runID)
+	text := fmt.Sprintf("Run #%d completed, see the results at %s\n", runID, common.Env.BASE_URL)
+	var logs []LatencyLog
+	if runErr != nil {
+		subject = fmt.Sprintf("Run #%d failed", runID)
+		text = fmt.Sprintf("Run #%d failed: %v\n", runID, runErr)
+	} else {
+		err := db.Select(&logs, `SELECT * FROM latency_logs WHERE run_id = ? ORDER BY label`, runID)
+		if err != nil {
+			log.Printf("Error loading the results of run %d for its summary: %v", runID, err)
+			return
+		}
+	}
+
+	html, err := common.RenderEmail(run_summary_email(subject, logs, runErr))
+	if err == nil {
+		err = common.QueueEmail(common.Email{To: to, Subject: subject, Text: text, HTML: html})
+	}
+	if err != nil {
+		log.Printf("Error emailing the summary of run %d: %v", runID, err)
+		errorsTotal.WithLabelValues("summary").Inc()
+	}
+}
+
+type webhookNotifier struct {
+	url    string
+	client *http.Client
+}
+
+func (n webhookNotifier) Name() string { return "webhook " + n.url }
+
+// Posts {"alerts": [...]} with a text summary, which chat tools like Slack
+// display as the message.
+func (n webhookNotifier) Notify(alerts []Alert) error {
+	lines := make([]string, len(alerts))
+	for i, alert := range alerts {
+		lines[i] = alert.String()
+	}
+	payload, err := json.Marshal(map[string]any{
+		"text":   "Latency alerts:\n" + strings.Join(lines, "\n"),
+		"alerts": alerts,
+	})
+	if err != nil {
+		return err
+	}
+
+	resp, err := n.client.Post(n.url, "application/json", bytes.NewReader(payload))
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode >= 300 {
+		return fmt.Errorf("webhook responded with %s", resp.Status)
+	}
+	return nil
+}
@@ -0,0 +1,79 @@
+package latency_simulations
+
+import (
+	"fmt"
+
+	"github.com/jackc/pgx/v5"
+	"go.opentelemetry.io/otel/attribute"
+)
+
+// Pipeline workloads send a number of independent reads (Read2 lookups) to
+// Postgres either one after the other, or queued in a pgx.Batch which is sent
+// as a single pipeline. Over long links the round trips dominate, so this
+// shows how much pipelining amortizes them. Both go through pgxpool no matter
+// the scenario's client, so they're measured once per scenario, see
+// runWorkloads.
+
+// Number of independent reads per batch.
+var pipelineBatchSizes = []int{10, 50}
+
+// Batches measured per workload & batch size.
+const pipelineBatchCount = 20
+
+func pipelineWorkloads(t *target) []workload {
+	if t.pool == nil {
+		return []workload{}
+	}
+
+	result := []workload{}
+	for _, size := range pipelineBatchSizes {
+		result = append(result,
+			workload{name: fmt.Sprintf("Sequential%d", size), run: sequentialReads(size), iterations: pipelineBatchCount, queries: size, keyed: true},
+			workload{name: fmt.Sprintf("Pipeline%d", size), run: pipelinedReads(size), iterations: pipelineBatchCount, queries: size, keyed: true},
+		)
+	}
+	return result
+}
+
+// Sends the reads one after the other, waiting for each result.
+func sequentialReads(size int) func(t *target, i int) error {
+	return func(t *target, i int) error {
+		query := t.db.Rebind(read2Query)
+		for q := 0; q < size; q++ {
+			var p product
+			ctx, span := t.startQuery(query)
+			err := t.pool.QueryRow(ctx, query, t.randomProductName()).Scan(&p.ID, &p.Name, &p.Price)
+			endSpan(span, err)
+			if err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+}
+
+// Queues the reads in a pgx.Batch and sends them in one go. The batch is
+// traced as a single query span, as its reads share the round trips.
+func pipelinedReads(size int) func(t *target, i int) error {
+	return func(t *target, i int) (err error) {
+		query := t.db.Rebind(read2Query)
+		batch := &pgx.Batch{}
+		for q := 0; q < size; q++ {
+			batch.Queue(query, t.randomProductName())
+		}
+
+		ctx, span := t.startQuery(query, attribute.Int("db.batch_size", size))
+		defer func() { endSpan(span, err) }()
+
+		results := t.pool.SendBatch(ctx, batch)
+		for q := 0; q < size; q++ {
+			var p product
+			err := results.QueryRow().Scan(&p.ID, &p.Name, &p.Price)
+			if err != nil {
+				results.Close()
+				return err
+			}
+		}
+		return results.Close()
+	}
+}
@@ -0,0 +1,40 @@
+package latency_simulations
+
+import (
+	"github.com/jackc/pgx/v5"
+	"github.com/jackc/pgx/v5/stdlib"
+	"github.com/jmoiron/sqlx"
+)
+
+// Query modes change how the base workloads (Read1, Read2, Write1 and the
+// review fetches) send their queries. Depending on the driver, a query with
+// arguments can cost an extra round trip to parse it, which adds up quickly
+// over long links. The base workloads always run unprepared; when enabled,
+// they also run in the modes below:
+//
+// - prepared: every query is prepared once with sqlx.Preparex and reused.
+//
+// - cached: Postgres only. Queries go through pgx's stdlib driver in
+// QueryExecModeCacheStatement, where the driver prepares statements with the
+// extended protocol and caches them per connection.
+func runQueryModes(t *target, opts SimulationOptions) ([]WorkloadResult, error) {
+	prepared := &target{db: t.db, dsn: t.dsn, pool: t.pool, products: t.products, prepared: true, ctx: t.ctx}
+	defer prepared.closeStmts()
+
+	results, err := measureWorkloads(prepared, workloads, "/prepared", opts)
+	if err != nil || !isPostgres(t.db) {
+		return results, err
+	}
+
+	config, err := pgx.ParseConfig(t.dsn)
+	if err != nil {
+		return results, err
+	}
+	config.DefaultQueryExecMode = pgx.QueryExecModeCacheStatement
+	cachedDb := sqlx.NewDb(stdlib.OpenDB(*config), "pgx")
+	defer cachedDb.Close()
+
+	cached := &target{db: cachedDb, dsn: t.dsn, pool: t.pool, products: t.products, ctx: t.ctx}
+	cachedResults, err := measureWorkloads(cached, workloads, "/cached", opts)
+	return append(results, cachedResults...), err
+}
@@ -1,27 +1,31 @@
 package latency_simulations
 
 import (
+	"fmt"
 	"go-on-rails/common"
-	"time"
+	"go-on-rails/users"
+	"net/url"
 
 	"github.com/gofiber/fiber/v2"
 )
 
 func AddRoutes(app *fiber.App) {
-	app.Get("/", func(c *fiber.Ctx) error {
+	// the page issues the CSRF token of the forms that trigger simulations
+	app.Get("/", users.RequireViewer, common.CSRF, func(c *fiber.Ctx) error {
 		sortBy := c.Query("sort_by", "label")
 		sortOrder := c.Query("sort_order", "asc")
 
 		// Validate sort parameters
 		validSortColumns := map[string]bool{
-			"label":  true,
-			"median": true,
-			"p10":    true,
-			"p25":    true,
-			"p75":    true,
-			"p90":    true,
-			"p95":    true,
-			"count":  true,
+			"label":    true,
+			"median":   true,
+			"p10":      true,
+			"p25":      true,
+			"p75":      true,
+			"p90":      true,
+			"p95":      true,
+			"count":    true,
+			"baseline": true,
 		}
 
 		if !validSortColumns[sortBy] {
@@ -34,14 +38,15 @@ func AddRoutes(app *fiber.App) {
 
 		// Map the URL parameter to the actual column name
 		columnMapping := map[string]string{
-			"label":  "label",
-			"median": "median_latency",
-			"p10":    "p10_latency",
-			"p25":    "p25_latency",
-			"p75":    "p75_latency",
-			"p90":    "p90_latency",
-			"p95":    "p95_latency",
-			"count":  "count",
+			"label":    "label",
+			"median":   "median_latency",
+			"p10":      "p10_latency",
+			"p25":      "p25_latency",
+			"p75":      "p75_latency",
+			"p90":      "p90_latency",
+			"p95":      "p95_latency",
+			"count":    "count",
+			"baseline": "baseline_ratio",
 		}
 
 		sqlColumn := columnMapping[sortBy]
@@ -51,21 +56,415 @@ func AddRoutes(app *fiber.App) {
 			return c.Status(500).SendString(err.Error())
 		}
 
-		// Set cache headers
-		common.SetCacheHeader(c, common.CacheOptions{
-			MaxAge:               time.Minute * 5, // Cache for 5 minutes
-			StaleWhileRevalidate: time.Minute * 1, // Allow stale content for 1 minute while revalidating
-			StaleIfError:         time.Minute * 5, // Allow stale content for 5 minutes on error
-		})
+		run, err := latestRun()
+		if err != nil {
+			return c.Status(500).SendString(err.Error())
+		}
+
+		// Don't cache, the page carries the visitor's CSRF token
+		c.Set("Cache-Control", "no-store")
+
+		alerts, err := listAlerts()
+		if err != nil {
+			return c.Status(500).SendString(err.Error())
+		}
+
+		user, err := users.CurrentUser(c)
+		if err != nil {
+			return c.Status(500).SendString(err.Error())
+		}
 
-		return common.RenderTempl(c, home_page(logs))
+		return common.RenderTempl(c, home_page(logs, run, alerts, c.Query("notice"), user, common.CSRFToken(c)))
 	})
 
-	app.Get("/simulate", func(c *fiber.Ctx) error {
-		err := simulateAll()
+	// Simulations drop & seed tables on every configured database, so they're
+	// only triggered by runners through CSRF protected POSTs, never by crawlers
+	// or link prefetching.
+	app.Post("/simulate", users.RequireRole(users.Runner), common.CSRF, func(c *fiber.Ctx) error {
+		opts := newSimulationOptions()
+		err := c.BodyParser(&opts)
+		if err != nil {
+			return c.Status(400).SendString(err.Error())
+		}
+		err = opts.validate()
+		if err != nil {
+			return c.Status(400).SendString(err.Error())
+		}
+
+		return queueSimulation(c, opts)
+	})
+
+	// Runs a simulation again with the options & seed of a previous run,
+	// so it issues the same operations.
+	app.Post("/runs/:id/rerun", users.RequireRole(users.Runner), common.CSRF, func(c *fiber.Ctx) error {
+		id, err := c.ParamsInt("id")
+		if err != nil {
+			return c.Status(400).SendString(err.Error())
+		}
+		run, err := runByID(id)
 		if err != nil {
 			return c.Status(500).SendString(err.Error())
 		}
-		return c.Redirect("/")
+		if run == nil {
+			return c.Status(404).SendString("run not found")
+		}
+
+		opts, err := run.SimulationOptions()
+		if err != nil {
+			return c.Status(500).SendString(err.Error())
+		}
+		return queueSimulation(c, opts)
+	})
+
+	addScenarioRoutes(app)
+	addScheduleRoutes(app)
+	addWebhookRoutes(app)
+}
+
+// Scenario management, for admins. The pages post forms, the API under
+// /api/scenarios takes & returns JSON and is meant for basic auth clients.
+func addScenarioRoutes(app *fiber.App) {
+	pages := app.Group("/scenarios", users.RequireRole(users.Admin), common.CSRF)
+
+	pages.Get("/", func(c *fiber.Ctx) error {
+		scenarios, err := listScenarios()
+		if err != nil {
+			return c.Status(500).SendString(err.Error())
+		}
+		c.Set("Cache-Control", "no-store")
+		return common.RenderTempl(c, scenarios_page(scenarios, common.CSRFToken(c)))
 	})
+
+	pages.Post("/", func(c *fiber.Ctx) error {
+		var scenario Scenario
+		err := c.BodyParser(&scenario)
+		if err != nil {
+			return c.Status(400).SendString(err.Error())
+		}
+		err = createScenario(&scenario)
+		if err != nil {
+			return c.Status(400).SendString(err.Error())
+		}
+		return c.Redirect("/scenarios")
+	})
+
+	pages.Get("/:id", func(c *fiber.Ctx) error {
+		scenario, err := scenarioFromParams(c)
+		if err != nil || scenario == nil {
+			return err
+		}
+		c.Set("Cache-Control", "no-store")
+		return common.RenderTempl(c, scenario_page(*scenario, common.CSRFToken(c)))
+	})
+
+	pages.Post("/:id", func(c *fiber.Ctx) error {
+		scenario, err := scenarioFromParams(c)
+		if err != nil || scenario == nil {
+			return err
+		}
+		scenario.Enabled = false // unchecked checkboxes aren't posted
+		err = c.BodyParser(scenario)
+		if err != nil {
+			return c.Status(400).SendString(err.Error())
+		}
+		err = updateScenario(scenario)
+		if err != nil {
+			return c.Status(400).SendString(err.Error())
+		}
+		return c.Redirect("/scenarios")
+	})
+
+	pages.Post("/:id/delete", func(c *fiber.Ctx) error {
+		scenario, err := scenarioFromParams(c)
+		if err != nil || scenario == nil {
+			return err
+		}
+		err = deleteScenario(scenario.ID)
+		if err != nil {
+			return c.Status(500).SendString(err.Error())
+		}
+		return c.Redirect("/scenarios")
+	})
+
+	// called with htmx, the response replaces the button's status text
+	pages.Post("/:id/test", func(c *fiber.Ctx) error {
+		scenario, err := scenarioFromParams(c)
+		if err != nil || scenario == nil {
+			return err
+		}
+		ping, err := scenario.testConnection()
+		if err != nil {
+			return c.SendString("Failed: " + err.Error())
+		}
+		return c.SendString(fmt.Sprintf("Connected, ping %.2f ms", ping.Seconds()*1000))
+	})
+
+	api := app.Group("/api/scenarios", users.RequireRole(users.Admin), common.CSRF)
+
+	api.Get("/", func(c *fiber.Ctx) error {
+		scenarios, err := listScenarios()
+		if err != nil {
+			return c.Status(500).JSON(fiber.Map{"error": err.Error()})
+		}
+		for i := range scenarios {
+			scenarios[i].DSN = scenarios[i].MaskedDSN()
+		}
+		return c.JSON(scenarios)
+	})
+
+	api.Post("/", func(c *fiber.Ctx) error {
+		scenario := Scenario{Enabled: true} // unless the body says otherwise
+		err := c.BodyParser(&scenario)
+		if err != nil {
+			return c.Status(400).JSON(fiber.Map{"error": err.Error()})
+		}
+		err = createScenario(&scenario)
+		if err != nil {
+			return c.Status(400).JSON(fiber.Map{"error": err.Error()})
+		}
+		scenario.DSN = scenario.MaskedDSN()
+		return c.Status(201).JSON(scenario)
+	})
+
+	api.Put("/:id", func(c *fiber.Ctx) error {
+		scenario, err := scenarioFromParams(c)
+		if err != nil || scenario == nil {
+			return err
+		}
+		err = c.BodyParser(scenario)
+		if err != nil {
+			return c.Status(400).JSON(fiber.Map{"error": err.Error()})
+		}
+		err = updateScenario(scenario)
+		if err != nil {
+			return c.Status(400).JSON(fiber.Map{"error": err.Error()})
+		}
+		scenario.DSN = scenario.MaskedDSN()
+		return c.JSON(scenario)
+	})
+
+	api.Delete("/:id", func(c *fiber.Ctx) error {
+		scenario, err := scenarioFromParams(c)
+		if err != nil || scenario == nil {
+			return err
+		}
+		err = deleteScenario(scenario.ID)
+		if err != nil {
+			return c.Status(500).JSON(fiber.Map{"error": err.Error()})
+		}
+		return c.SendStatus(204)
+	})
+
+	api.Post("/:id/test", func(c *fiber.Ctx) error {
+		scenario, err := scenarioFromParams(c)
+		if err != nil || scenario == nil {
+			return err
+		}
+		ping, err := scenario.testConnection()
+		if err != nil {
+			return c.JSON(fiber.Map{"ok": false, "error": err.Error()})
+		}
+		return c.JSON(fiber.Map{"ok": true, "ping_ms": ping.Seconds() * 1000})
+	})
+}
+
+// Loads the scenario of the :id param. When it returns a nil scenario, the
+// response was already sent, e.g. a 404, and the error (if any) should be
+// returned by the handler.
+func scenarioFromParams(c *fiber.Ctx) (*Scenario, error) {
+	id, err := c.ParamsInt("id")
+	if err != nil {
+		return nil, c.Status(400).SendString(err.Error())
+	}
+	scenario, err := scenarioByID(id)
+	if err != nil {
+		return nil, c.Status(500).SendString(err.Error())
+	}
+	if scenario == nil {
+		return nil, c.Status(404).SendString("scenario not found")
+	}
+	return scenario, nil
+}
+
+// Schedules can be viewed by anyone who can see the results, and are managed
+// by admins. See scheduler.go.
+func addScheduleRoutes(app *fiber.App) {
+	schedules := app.Group("/schedules", common.CSRF)
+
+	schedules.Get("/", users.RequireViewer, func(c *fiber.Ctx) error {
+		list, err := listSchedules()
+		if err != nil {
+			return c.Status(500).SendString(err.Error())
+		}
+		upcoming, err := upcomingRuns()
+		if err != nil {
+			return c.Status(500).SendString(err.Error())
+		}
+		past, err := listScheduledRuns()
+		if err != nil {
+			return c.Status(500).SendString(err.Error())
+		}
+		scenarios, err := listScenarios()
+		if err != nil {
+			return c.Status(500).SendString(err.Error())
+		}
+		user, err := users.CurrentUser(c)
+		if err != nil {
+			return c.Status(500).SendString(err.Error())
+		}
+		c.Set("Cache-Control", "no-store")
+		return common.RenderTempl(c, schedules_page(list, upcoming, past, scenarios, user, common.CSRFToken(c)))
+	})
+
+	// the form holds the schedule's fields and the options of its runs
+	schedules.Post("/", users.RequireRole(users.Admin), func(c *fiber.Ctx) error {
+		schedule := Schedule{JitterSeconds: defaultJitterSeconds}
+		err := c.BodyParser(&schedule)
+		if err != nil {
+			return c.Status(400).SendString(err.Error())
+		}
+		opts := newSimulationOptions()
+		err = c.BodyParser(&opts)
+		if err != nil {
+			return c.Status(400).SendString(err.Error())
+		}
+		err = schedule.setSimulationOptions(opts)
+		if err != nil {
+			return c.Status(400).SendString(err.Error())
+		}
+		err = createSchedule(&schedule)
+		if err != nil {
+			return c.Status(400).SendString(err.Error())
+		}
+		return c.Redirect("/schedules")
+	})
+
+	schedules.Post("/:id/enabled", users.RequireRole(users.Admin), func(c *fiber.Ctx) error {
+		id, err := c.ParamsInt("id")
+		if err != nil {
+			return c.Status(400).SendString(err.Error())
+		}
+		err = setScheduleEnabled(id, c.FormValue("enabled") == "true")
+		if err != nil {
+			return c.Status(500).SendString(err.Error())
+		}
+		return c.Redirect("/schedules")
+	})
+
+	schedules.Post("/:id/delete", users.RequireRole(users.Admin), func(c *fiber.Ctx) error {
+		id, err := c.ParamsInt("id")
+		if err != nil {
+			return c.Status(400).SendString(err.Error())
+		}
+		err = deleteSchedule(id)
+		if err != nil {
+			return c.Status(500).SendString(err.Error())
+		}
+		return c.Redirect("/schedules")
+	})
+}
+
+// Webhooks hold secrets, so they're managed by admins. See webhooks.go.
+func addWebhookRoutes(app *fiber.App) {
+	webhooks := app.Group("/webhooks", users.RequireRole(users.Admin), common.CSRF)
+
+	webhooks.Get("/", func(c *fiber.Ctx) error {
+		list, err := listWebhooks()
+		if err != nil {
+			return c.Status(500).SendString(err.Error())
+		}
+		c.Set("Cache-Control", "no-store")
+		return common.RenderTempl(c, webhooks_page(list, common.CSRFToken(c)))
+	})
+
+	webhooks.Get("/deliveries", func(c *fiber.Ctx) error {
+		deliveries, err := listWebhookDeliveries()
+		if err != nil {
+			return c.Status(500).SendString(err.Error())
+		}
+		c.Set("Cache-Control", "no-store")
+		return common.RenderTempl(c, webhook_deliveries_page(deliveries))
+	})
+
+	webhooks.Post("/", func(c *fiber.Ctx) error {
+		var webhook Webhook
+		err := c.BodyParser(&webhook)
+		if err != nil {
+			return c.Status(400).SendString(err.Error())
+		}
+		err = createWebhook(&webhook)
+		if err != nil {
+			return c.Status(400).SendString(err.Error())
+		}
+		return c.Redirect("/webhooks")
+	})
+
+	webhooks.Post("/:id/enabled", func(c *fiber.Ctx) error {
+		id, err := c.ParamsInt("id")
+		if err != nil {
+			return c.Status(400).SendString(err.Error())
+		}
+		err = setWebhookEnabled(id, c.FormValue("enabled") == "true")
+		if err != nil {
+			return c.Status(500).SendString(err.Error())
+		}
+		return c.Redirect("/webhooks")
+	})
+
+	webhooks.Post("/:id/secret", func(c *fiber.Ctx) error {
+		id, err := c.ParamsInt("id")
+		if err != nil {
+			return c.Status(400).SendString(err.Error())
+		}
+		err = setWebhookSecret(id, c.FormValue("secret"))
+		if err != nil {
+			return c.Status(500).SendString(err.Error())
+		}
+		return c.Redirect("/webhooks")
+	})
+
+	webhooks.Post("/:id/delete", func(c *fiber.Ctx) error {
+		id, err := c.ParamsInt("id")
+		if err != nil {
+			return c.Status(400).SendString(err.Error())
+		}
+		err = deleteWebhook(id)
+		if err != nil {
+			return c.Status(500).SendString(err.Error())
+		}
+		return c.Redirect("/webhooks")
+	})
+
+	// called with htmx, the response replaces the button's status text
+	webhooks.Post("/:id/test", func(c *fiber.Ctx) error {
+		id, err := c.ParamsInt("id")
+		if err != nil {
+			return c.Status(400).SendString(err.Error())
+		}
+		webhook, err := webhookByID(id)
+		if err != nil {
+			return c.Status(500).SendString(err.Error())
+		}
+		if webhook == nil {
+			return c.Status(404).SendString("webhook not found")
+		}
+		delivery := testWebhook(*webhook)
+		if delivery.Error != "" {
+			return c.SendString("Failed: " + delivery.Error)
+		}
+		return c.SendString(fmt.Sprintf("Responded %d", delivery.StatusCode))
+	})
+}
+
+// Queues a run and redirects home, with a notice since the results only
+// show up once the run completes.
+func queueSimulation(c *fiber.Ctx, opts SimulationOptions) error {
+	err := simulationQueue.Add(simulateJob, "all", opts)
+	if err == common.ErrJobLocked {
+		return c.Redirect("/?notice=" + url.QueryEscape("A simulation is already queued or running, try again once it completes."))
+	}
+	if err != nil {
+		return c.Status(500).SendString(err.Error())
+	}
+	return c.Redirect("/?notice=" + url.QueryEscape("The simulation is queued, refresh the page to see its results once it completes."))
 }
@@ -0,0 +1,119 @@
+package latency_simulations
+
+import (
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"go-on-rails/common"
+	"time"
+
+	"github.com/jmoiron/sqlx"
+)
+
+// Every simulation run is recorded with the options it ran with, so the
+// latency logs can be read knowing e.g. which key distribution was used.
+// Unlike latency_logs, runs are kept across simulations. Failed runs are
+// recorded too, with their error, so webhooks & emails can refer to them.
+
+type SimulationRun struct {
+	ID        int       `db:"id"`
+	Options   string    `db:"options"` // JSON encoded SimulationOptions
+	Error     string    `db:"error"`   // empty unless the run failed
+	CreatedAt time.Time `db:"created_at"`
+}
+
+// Decodes the options the run was started with.
+func (r SimulationRun) SimulationOptions() (SimulationOptions, error) {
+	var opts SimulationOptions
+	err := json.Unmarshal([]byte(r.Options), &opts)
+	return opts, err
+}
+
+// A short description of the run for the UI, e.g.
+// "Run #3: 1,000 products × 10 reviews of 1,024 B, 100 queries, seed 42, zipfian keys (skew 1.10)".
+func (r SimulationRun) Description() string {
+	opts, err := r.SimulationOptions()
+	if err != nil {
+		return fmt.Sprintf("Run #%d", r.ID)
+	}
+
+	description := common.Printer.Sprintf("Run #%d: %d products × %d reviews", r.ID, opts.Products, opts.ReviewsPerProduct)
+	if opts.PayloadSize > 0 {
+		description += common.Printer.Sprintf(" of %d B", opts.PayloadSize)
+	}
+	description += common.Printer.Sprintf(", %d queries, seed %d, %s keys", opts.Queries, opts.Seed, opts.KeyDistribution)
+	switch opts.KeyDistribution {
+	case Zipfian, Latest:
+		description += fmt.Sprintf(" (skew %.2f)", opts.ZipfianSkew)
+	case Hotspot:
+		description += fmt.Sprintf(" (%d%% of ops on %d%% of keys)", opts.HotspotOps, opts.HotspotKeys)
+	}
+	if opts.WorkloadDistributions != "" {
+		description += ", overrides " + opts.WorkloadDistributions
+	}
+	return description
+}
+
+func createRunsTable(db *sqlx.DB) error {
+	_, err := db.Exec(`CREATE TABLE IF NOT EXISTS simulation_runs (
+			id INTEGER PRIMARY KEY AUTOINCREMENT,
+			options TEXT NOT NULL,
+			error TEXT NOT NULL DEFAULT '',
+			created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP
+		)`)
+	if err != nil {
+		return err
+	}
+
+	// failed runs used to not be recorded
+	return addMissingColumn(db, "simulation_runs", "error", `TEXT NOT NULL DEFAULT ''`)
+}
+
+// Records a run with the given options and returns its id.
+func insertRun(tx *sqlx.Tx, opts SimulationOptions) (int64, error) {
+	options, err := json.Marshal(opts)
+	if err != nil {
+		return 0, err
+	}
+	result, err := tx.Exec(`INSERT INTO simulation_runs (options) VALUES (?)`, string(options))
+	if err != nil {
+		return 0, err
+	}
+	return result.LastInsertId()
+}
+
+// Records a run that failed before its results were written, and returns
+// its id.
+func insertFailedRun(opts SimulationOptions, runErr error) (int64, error) {
+	options, err := json.Marshal(opts)
+	if err != nil {
+		return 0, err
+	}
+	result, err := db.Exec(`INSERT INTO simulation_runs (options, error) VALUES (?, ?)`, string(options), runErr.Error())
+	if err != nil {
+		return 0, err
+	}
+	return result.LastInsertId()
+}
+
+// Returns the most recent successful run, or nil if none succeeded yet.
+func latestRun() (*SimulationRun, error) {
+	return getRun(`SELECT id, options, error, created_at FROM simulation_runs WHERE error = '' ORDER BY id DESC LIMIT 1`)
+}
+
+// Returns the run with the given id, or nil if there's none.
+func runByID(id int) (*SimulationRun, error) {
+	return getRun(`SELECT id, options, error, created_at FROM simulation_runs WHERE id = ?`, id)
+}
+
+func getRun(query string, args ...any) (*SimulationRun, error) {
+	var run SimulationRun
+	err := db.Get(&run, query, args...)
+	if err == sql.ErrNoRows {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	return &run, nil
+}
@@ -0,0 +1,316 @@
+package latency_simulations
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"go-on-rails/common"
+	"net/url"
+	"regexp"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/jmoiron/sqlx"
+	"github.com/redis/go-redis/v9"
+)
+
+// Besides the Postgres scenarios configured through env variables, scenarios
+// can be managed in the UI (or API) without a restart. They're stored in the
+// app's SQLite db, with their DSN encrypted (see common.Encrypt), and every
+// enabled one runs with the other scenarios.
+
+type Scenario struct {
+	ID   int    `db:"id" json:"id"`
+	Name string `db:"name" json:"name" form:"name"`
+
+	Driver PostgresClient `db:"driver" json:"driver" form:"driver"`
+
+	// Only set when creating or updating a scenario; it's stored encrypted.
+	// Updates with an empty DSN keep the stored one. API responses set it
+	// to the masked DSN.
+	DSN          string `db:"-" json:"dsn" form:"dsn"`
+	EncryptedDSN string `db:"encrypted_dsn" json:"-"`
+
+	// Comma separated, e.g. "staging,eu". Only informative.
+	Tags string `db:"tags" json:"tags" form:"tags"`
+
+	// Comma separated names of the workloads to run, e.g. "Read2,Join".
+	// Empty runs all of them. The query modes of a base workload can also be
+	// picked on their own, e.g. "Read2/prepared".
+	Workloads string `db:"workloads" json:"workloads" form:"workloads"`
+
+	Enabled   bool      `db:"enabled" json:"enabled" form:"enabled"`
+	CreatedAt time.Time `db:"created_at" json:"created_at"`
+	UpdatedAt time.Time `db:"updated_at" json:"updated_at"`
+}
+
+// Names of the workloads a scenario can pick. Every client runs the same
+// ones, as the pipelines and COPY go through pgxpool whatever the client.
+// CacheAside is named after the hit ratio of the run, so any ratio goes.
+var (
+	scenarioBaseWorkloads  = []string{"Read1", "Read2", "Write1", "NPlusOne", "Join", "Batched"}
+	scenarioQueryModes     = []string{"/prepared", "/cached"}
+	scenarioOtherWorkloads = []string{
+		"LocalCache",
+		"TxReadCommitted", "TxReadCommittedContended",
+		"TxRepeatableRead", "TxRepeatableReadContended",
+		"TxSerializable", "TxSerializableContended",
+		"Sequential10", "Pipeline10", "Sequential50", "Pipeline50",
+		"BulkRowByRow10", "BulkPrepared10", "BulkValues10", "BulkCopy10",
+		"BulkRowByRow100", "BulkPrepared100", "BulkValues100", "BulkCopy100",
+		"BulkRowByRow1000", "BulkPrepared1000", "BulkValues1000", "BulkCopy1000",
+	}
+)
+
+// Names of the built-in scenarios, which managed ones can't reuse
+// since results are labeled by scenario.
+var reservedScenarioNames = []string{"SQLite", "SameBox", "IntraAZ", "InterAZ", "InterRegion", "Cache"}
+
+var scenarioNamePattern = regexp.MustCompile(`^[A-Za-z0-9_-]+$`)
+
+func createScenariosTable(db sqlx.Ext) error {
+	_, err := db.Exec(`CREATE TABLE IF NOT EXISTS scenarios (
+			id INTEGER PRIMARY KEY AUTOINCREMENT,
+			name TEXT NOT NULL UNIQUE,
+			driver TEXT NOT NULL,
+			encrypted_dsn TEXT NOT NULL,
+			tags TEXT NOT NULL DEFAULT '',
+			workloads TEXT NOT NULL DEFAULT '',
+			enabled BOOLEAN NOT NULL DEFAULT TRUE,
+			created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
+			updated_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP
+		)`)
+	if err != nil {
+		return err
+	}
+	// scenarios used to store a network profile, which nothing read
+	return dropColumn(db, "scenarios", "network_profile")
+}
+
+func (s *Scenario) validate() error {
+	if !scenarioNamePattern.MatchString(s.Name) {
+		return fmt.Errorf("scenario names can only contain letters, digits, _ and -")
+	}
+	for _, name := range reservedScenarioNames {
+		if strings.EqualFold(s.Name, name) {
+			return fmt.Errorf("%s is the name of a built-in scenario", s.Name)
+		}
+	}
+	switch s.Driver {
+	case LibPQ, PgxStdlib, PgxPool:
+	default:
+		return fmt.Errorf("unknown postgres client %q", s.Driver)
+	}
+	for _, name := range splitList(s.Workloads) {
+		if !isPostgresWorkload(name) {
+			return fmt.Errorf("unknown workload %q", name)
+		}
+	}
+	return nil
+}
+
+// Whether a scenario can run the named workload, see scenarioBaseWorkloads.
+func isPostgresWorkload(name string) bool {
+	if ratio, ok := strings.CutPrefix(name, "CacheAside"); ok {
+		_, err := strconv.Atoi(ratio)
+		return err == nil
+	}
+	for _, mode := range scenarioQueryModes {
+		if base, ok := strings.CutSuffix(name, mode); ok {
+			return slices.Contains(scenarioBaseWorkloads, base)
+		}
+	}
+	return slices.Contains(scenarioBaseWorkloads, name) || slices.Contains(scenarioOtherWorkloads, name)
+}
+
+// Label of the scenario's results, e.g. "staging/pgx".
+func (s Scenario) Label() string {
+	return s.Name + "/" + string(s.Driver)
+}
+
+func (s Scenario) TagList() []string {
+	return splitList(s.Tags)
+}
+
+// Returns the DSN with its password masked, for display.
+func (s Scenario) MaskedDSN() string {
+	dsn, err := common.Decrypt(s.EncryptedDSN)
+	if err != nil {
+		return "(can't decrypt, was SECRET_KEY changed?)"
+	}
+	return maskDSN(dsn)
+}
+
+// Masks the password of a DSN in either the URL or the key/value form.
+func maskDSN(dsn string) string {
+	if strings.HasPrefix(dsn, "postgres://") || strings.HasPrefix(dsn, "postgresql://") {
+		u, err := url.Parse(dsn)
+		if err != nil {
+			return "(invalid DSN)"
+		}
+		if _, ok := u.User.Password(); ok {
+			u.User = url.UserPassword(u.User.Username(), "****")
+		}
+		query := u.Query()
+		if query.Has("password") {
+			query.Set("password", "****")
+			u.RawQuery = query.Encode()
+		}
+		return u.String()
+	}
+
+	fields := splitKeyValueDSN(dsn)
+	for i, pair := range fields {
+		if key, _, ok := strings.Cut(pair, "="); ok && key == "password" {
+			fields[i] = "password=****"
+		}
+	}
+	return strings.Join(fields, " ")
+}
+
+func splitList(s string) []string {
+	result := []string{}
+	for _, item := range strings.Split(s, ",") {
+		item = strings.TrimSpace(item)
+		if item != "" {
+			result = append(result, item)
+		}
+	}
+	return result
+}
+
+func listScenarios() ([]Scenario, error) {
+	scenarios := []Scenario{}
+	err := db.Select(&scenarios, `SELECT * FROM scenarios ORDER BY name`)
+	return scenarios, err
+}
+
+func enabledScenarios() ([]Scenario, error) {
+	scenarios := []Scenario{}
+	err := db.Select(&scenarios, `SELECT * FROM scenarios WHERE enabled ORDER BY name`)
+	return scenarios, err
+}
+
+// Returns the scenario with the given id, or nil if there's none.
+func scenarioByID(id int) (*Scenario, error) {
+	var scenario Scenario
+	err := db.Get(&scenario, `SELECT * FROM scenarios WHERE id = ?`, id)
+	if err == sql.ErrNoRows {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	return &scenario, nil
+}
+
+func createScenario(s *Scenario) error {
+	err := s.validate()
+	if err != nil {
+		return err
+	}
+	if s.DSN == "" {
+		return fmt.Errorf("a DSN is required")
+	}
+	if strings.Contains(s.DSN, "****") {
+		return fmt.Errorf("the DSN has a masked password")
+	}
+	s.EncryptedDSN, err = common.Encrypt(s.DSN)
+	if err != nil {
+		return err
+	}
+
+	result, err := db.NamedExec(`
+		INSERT INTO scenarios (name, driver, encrypted_dsn, tags, workloads, enabled)
+		VALUES (:name, :driver, :encrypted_dsn, :tags, :workloads, :enabled)
+	`, s)
+	if err != nil {
+		return err
+	}
+	id, err := result.LastInsertId()
+	s.ID = int(id)
+	return err
+}
+
+// Updates every field of the scenario. The DSN is only replaced if set.
+func updateScenario(s *Scenario) error {
+	err := s.validate()
+	if err != nil {
+		return err
+	}
+
+	// a DSN sent back as it was listed keeps the current one, any other
+	// masked DSN would store **** as the password
+	if s.DSN != "" && s.DSN == s.MaskedDSN() {
+		s.DSN = ""
+	}
+	if strings.Contains(s.DSN, "****") {
+		return fmt.Errorf("the DSN has a masked password")
+	}
+
+	query := `UPDATE scenarios SET name = :name, driver = :driver, tags = :tags, workloads = :workloads,
+		enabled = :enabled, updated_at = CURRENT_TIMESTAMP`
+	if s.DSN != "" {
+		s.EncryptedDSN, err = common.Encrypt(s.DSN)
+		if err != nil {
+			return err
+		}
+		query += `, encrypted_dsn = :encrypted_dsn`
+	}
+	_, err = db.NamedExec(query+` WHERE id = :id`, s)
+	return err
+}
+
+// Deletes the scenario, and its schedules with it (see scheduler.go).
+func deleteScenario(id int) error {
+	_, err := db.Exec(`DELETE FROM scenarios WHERE id = ?`, id)
+	if err != nil {
+		return err
+	}
+	return scheduler.reload()
+}
+
+const testConnectionTimeout = 5 * time.Second
+
+// Connects to the scenario's database and pings it. Returns how long the
+// ping took, to have a rough idea of the distance.
+func (s Scenario) testConnection() (time.Duration, error) {
+	dsn, err := common.Decrypt(s.EncryptedDSN)
+	if err != nil {
+		return 0, err
+	}
+	t, err := openPostgres(dsn, s.Driver)
+	if err != nil {
+		return 0, err
+	}
+	defer t.close()
+
+	ctx, cancel := context.WithTimeout(context.Background(), testConnectionTimeout)
+	defer cancel()
+	err = t.db.PingContext(ctx)
+	if err != nil {
+		return 0, err
+	}
+
+	// the first ping includes connecting, so time a second one
+	start := time.Now()
+	err = t.db.PingContext(ctx)
+	return time.Since(start), err
+}
+
+// Runs the simulation against the scenario's database, with only its workloads.
+func (s Scenario) simulate(ctx context.Context, cache *redis.Client, opts SimulationOptions) (Simulation, error) {
+	dsn, err := common.Decrypt(s.EncryptedDSN)
+	if err != nil {
+		return Simulation{}, err
+	}
+	if workloads := splitList(s.Workloads); len(workloads) > 0 {
+		opts.onlyWorkloads = map[string]bool{}
+		for _, name := range workloads {
+			opts.onlyWorkloads[name] = true
+		}
+	}
+	return simulatePostgres(ctx, dsn, s.Driver, cache, opts)
+}
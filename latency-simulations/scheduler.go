@@ -0,0 +1,427 @@
+package latency_simulations
+
+import (
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"log"
+	"math/rand"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/jmoiron/sqlx"
+	"github.com/robfig/cron/v3"
+)
+
+// Schedules run simulations in the background on a cron expression, so
+// latency is tracked continuously and not only when someone clicks the button.
+// A schedule runs either every scenario with a run profile (the options of
+// the run), or a single managed scenario. They're stored in the app's SQLite
+// db next to the history of their runs.
+//
+// A scheduled run that fires while another simulation is in progress is
+// skipped and recorded as such, it doesn't queue up behind allLock.
+
+type Schedule struct {
+	ID   int    `db:"id" form:"-"`
+	Name string `db:"name" form:"name"`
+
+	// Standard 5 fields cron expression, e.g. "*/15 * * * *", or a
+	// descriptor like "@hourly" or "@every 30m".
+	Cron string `db:"cron" form:"cron"`
+
+	// The managed scenario to run, or 0 to run all of them.
+	ScenarioID int `db:"scenario_id" form:"scenario_id"`
+
+	// JSON encoded SimulationOptions the runs start with.
+	Options string `db:"options" form:"-"`
+
+	// Runs start after a random delay of up to this many seconds, so
+	// schedules firing at the same time don't hit the databases in lockstep.
+	JitterSeconds int `db:"jitter_seconds" form:"jitter_seconds"`
+
+	Enabled   bool      `db:"enabled" form:"enabled"`
+	CreatedAt time.Time `db:"created_at" form:"-"`
+}
+
+type ScheduledRunStatus string
+
+const (
+	ScheduledRunRunning   ScheduledRunStatus = "running"
+	ScheduledRunSucceeded ScheduledRunStatus = "succeeded"
+	ScheduledRunFailed    ScheduledRunStatus = "failed"
+	ScheduledRunSkipped   ScheduledRunStatus = "skipped"
+)
+
+// A run started (or skipped) by a schedule.
+type ScheduledRun struct {
+	ID           int                `db:"id"`
+	ScheduleID   int                `db:"schedule_id"`
+	ScheduleName string             `db:"schedule_name"`
+	RunID        sql.NullInt64      `db:"run_id"` // the simulation run, unless it was skipped or failed
+	Status       ScheduledRunStatus `db:"status"`
+	Error        string             `db:"error"`
+	StartedAt    time.Time          `db:"started_at"`
+	FinishedAt   sql.NullTime       `db:"finished_at"`
+}
+
+// A schedule's next run, for the UI.
+type UpcomingRun struct {
+	Schedule Schedule
+	At       time.Time
+}
+
+const (
+	defaultJitterSeconds = 30
+	maxJitterSeconds     = 3600
+
+	// How many past scheduled runs the UI lists.
+	scheduledRunsListed = 50
+)
+
+var cronParser = cron.NewParser(cron.Minute | cron.Hour | cron.Dom | cron.Month | cron.Dow | cron.Descriptor)
+
+func createSchedulesTables(db sqlx.Execer) error {
+	_, err := db.Exec(`CREATE TABLE IF NOT EXISTS schedules (
+			id INTEGER PRIMARY KEY AUTOINCREMENT,
+			name TEXT NOT NULL UNIQUE,
+			cron TEXT NOT NULL,
+			scenario_id INTEGER REFERENCES scenarios (id) ON DELETE CASCADE,
+			options TEXT NOT NULL,
+			jitter_seconds INTEGER NOT NULL DEFAULT 0,
+			enabled BOOLEAN NOT NULL DEFAULT TRUE,
+			created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP
+		)`)
+	if err != nil {
+		return err
+	}
+
+	_, err = db.Exec(`CREATE TABLE IF NOT EXISTS scheduled_runs (
+			id INTEGER PRIMARY KEY AUTOINCREMENT,
+			schedule_id INTEGER NOT NULL REFERENCES schedules (id) ON DELETE CASCADE,
+			run_id INTEGER REFERENCES simulation_runs (id),
+			status TEXT NOT NULL,
+			error TEXT NOT NULL DEFAULT '',
+			started_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
+			finished_at TIMESTAMP
+		)`)
+	return err
+}
+
+func (s *Schedule) validate() error {
+	s.Name = strings.TrimSpace(s.Name)
+	if s.Name == "" {
+		return fmt.Errorf("a name is required")
+	}
+	_, err := cronParser.Parse(s.Cron)
+	if err != nil {
+		return fmt.Errorf("invalid cron expression %q: %w", s.Cron, err)
+	}
+	if s.JitterSeconds < 0 || s.JitterSeconds > maxJitterSeconds {
+		return fmt.Errorf("the jitter must be between 0 and %d seconds", maxJitterSeconds)
+	}
+	if s.ScenarioID != 0 {
+		scenario, err := scenarioByID(s.ScenarioID)
+		if err != nil {
+			return err
+		}
+		if scenario == nil {
+			return fmt.Errorf("scenario %d not found", s.ScenarioID)
+		}
+	}
+	_, err = s.SimulationOptions()
+	return err
+}
+
+// Sets the run profile of the schedule, with defaults filled in.
+func (s *Schedule) setSimulationOptions(opts SimulationOptions) error {
+	seed := opts.Seed
+	opts.setDefaults()
+	opts.Seed = seed // 0 keeps reusing the latest run's seed, like manual runs
+	err := opts.validate()
+	if err != nil {
+		return err
+	}
+	options, err := json.Marshal(opts)
+	s.Options = string(options)
+	return err
+}
+
+// Decodes the run profile of the schedule.
+func (s Schedule) SimulationOptions() (SimulationOptions, error) {
+	var opts SimulationOptions
+	err := json.Unmarshal([]byte(s.Options), &opts)
+	return opts, err
+}
+
+// The run profile, described like a run, e.g. "1,000 products × 10 reviews, ...".
+func (s Schedule) Description() string {
+	description := SimulationRun{Options: s.Options}.Description()
+	_, description, _ = strings.Cut(description, ": ")
+	return description
+}
+
+// Returns the next time the schedule fires after t, before jitter.
+func (s Schedule) Next(t time.Time) time.Time {
+	schedule, err := cronParser.Parse(s.Cron)
+	if err != nil {
+		return time.Time{}
+	}
+	return schedule.Next(t)
+}
+
+// The schedule's columns, with the all-scenarios NULL read as 0.
+const scheduleColumns = `id, name, cron, COALESCE(scenario_id, 0) AS scenario_id, options, jitter_seconds, enabled, created_at`
+
+func listSchedules() ([]Schedule, error) {
+	schedules := []Schedule{}
+	err := db.Select(&schedules, `SELECT `+scheduleColumns+` FROM schedules ORDER BY name`)
+	return schedules, err
+}
+
+// Returns the schedule with the given id, or nil if there's none.
+func scheduleByID(id int) (*Schedule, error) {
+	var schedule Schedule
+	err := db.Get(&schedule, `SELECT `+scheduleColumns+` FROM schedules WHERE id = ?`, id)
+	if err == sql.ErrNoRows {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	return &schedule, nil
+}
+
+func createSchedule(s *Schedule) error {
+	err := s.validate()
+	if err != nil {
+		return err
+	}
+	result, err := db.Exec(`INSERT INTO schedules (name, cron, scenario_id, options, jitter_seconds, enabled) VALUES (?, ?, ?, ?, ?, ?)`,
+		s.Name, s.Cron, nullableID(s.ScenarioID), s.Options, s.JitterSeconds, s.Enabled)
+	if err != nil {
+		return err
+	}
+	id, err := result.LastInsertId()
+	s.ID = int(id)
+	if err != nil {
+		return err
+	}
+	return scheduler.reload()
+}
+
+func setScheduleEnabled(id int, enabled bool) error {
+	_, err := db.Exec(`UPDATE schedules SET enabled = ? WHERE id = ?`, enabled, id)
+	if err != nil {
+		return err
+	}
+	return scheduler.reload()
+}
+
+func deleteSchedule(id int) error {
+	_, err := db.Exec(`DELETE FROM schedules WHERE id = ?`, id)
+	if err != nil {
+		return err
+	}
+	return scheduler.reload()
+}
+
+func nullableID(id int) sql.NullInt64 {
+	return sql.NullInt64{Int64: int64(id), Valid: id != 0}
+}
+
+// Returns the most recent scheduled runs, newest first.
+func listScheduledRuns() ([]ScheduledRun, error) {
+	runs := []ScheduledRun{}
+	err := db.Select(&runs, `
+		SELECT r.id, r.schedule_id, s.name AS schedule_name, r.run_id, r.status, r.error, r.started_at, r.finished_at
+		FROM scheduled_runs r JOIN schedules s ON s.id = r.schedule_id
+		ORDER BY r.id DESC LIMIT ?
+	`, scheduledRunsListed)
+	return runs, err
+}
+
+// Returns the next run of every enabled schedule, soonest first.
+func upcomingRuns() ([]UpcomingRun, error) {
+	schedules, err := listSchedules()
+	if err != nil {
+		return nil, err
+	}
+	now := time.Now()
+	upcoming := []UpcomingRun{}
+	for _, schedule := range schedules {
+		if schedule.Enabled {
+			upcoming = append(upcoming, UpcomingRun{Schedule: schedule, At: schedule.Next(now)})
+		}
+	}
+	sort.Slice(upcoming, func(i, j int) bool { return upcoming[i].At.Before(upcoming[j].At) })
+	return upcoming, nil
+}
+
+func insertScheduledRun(scheduleID int, status ScheduledRunStatus) (int64, error) {
+	result, err := db.Exec(`INSERT INTO scheduled_runs (schedule_id, status) VALUES (?, ?)`, scheduleID, status)
+	if err != nil {
+		return 0, err
+	}
+	return result.LastInsertId()
+}
+
+func finishScheduledRun(id int64, runID int64, status ScheduledRunStatus, runErr error) error {
+	errorMessage := ""
+	if runErr != nil {
+		errorMessage = runErr.Error()
+	}
+	_, err := db.Exec(`UPDATE scheduled_runs SET run_id = ?, status = ?, error = ?, finished_at = CURRENT_TIMESTAMP WHERE id = ?`,
+		nullableID(int(runID)), status, errorMessage, id)
+	return err
+}
+
+// Runs the enabled schedules in the background.
+type schedulesRunner struct {
+	mu   sync.Mutex
+	cron *cron.Cron
+}
+
+var scheduler = &schedulesRunner{}
+
+// Starts running the enabled schedules. Runs that were interrupted by
+// a restart are marked as failed.
+func StartScheduler() error {
+	_, err := db.Exec(`UPDATE scheduled_runs SET status = ?, error = 'interrupted by a restart', finished_at = CURRENT_TIMESTAMP WHERE status = ?`,
+		ScheduledRunFailed, ScheduledRunRunning)
+	if err != nil {
+		return err
+	}
+
+	scheduler.mu.Lock()
+	// failed runs return errors, Recover only keeps a bug from taking the app down
+	scheduler.cron = cron.New(cron.WithParser(cronParser), cron.WithChain(cron.Recover(cron.DefaultLogger), cron.SkipIfStillRunning(cron.DefaultLogger)))
+	scheduler.cron.Start()
+	scheduler.mu.Unlock()
+	return scheduler.reload()
+}
+
+// Replaces the cron entries with the enabled schedules. It's a no-op until
+// the scheduler is started.
+func (r *schedulesRunner) reload() error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.cron == nil {
+		return nil
+	}
+
+	schedules, err := listSchedules()
+	if err != nil {
+		return err
+	}
+	for _, entry := range r.cron.Entries() {
+		r.cron.Remove(entry.ID)
+	}
+	for _, schedule := range schedules {
+		if !schedule.Enabled {
+			continue
+		}
+		id := schedule.ID
+		_, err = r.cron.AddFunc(schedule.Cron, func() { runSchedule(id) })
+		if err != nil {
+			return fmt.Errorf("schedule %s: %w", schedule.Name, err)
+		}
+	}
+	return nil
+}
+
+// Runs a schedule after its jitter, unless a simulation is in progress.
+func runSchedule(id int) {
+	schedule, err := scheduleByID(id)
+	if err != nil {
+		log.Printf("Error loading schedule %d: %v", id, err)
+		return
+	}
+	// deleted or disabled since it fired
+	if schedule == nil || !schedule.Enabled {
+		return
+	}
+
+	if schedule.JitterSeconds > 0 {
+		time.Sleep(time.Duration(rand.Int63n(int64(schedule.JitterSeconds) * int64(time.Second))))
+	}
+
+	scheduledRunID, err := insertScheduledRun(schedule.ID, ScheduledRunRunning)
+	if err != nil {
+		log.Printf("Error recording a run of schedule %s: %v", schedule.Name, err)
+		return
+	}
+
+	runID, status, err := runScheduleSimulations(*schedule)
+	if err != nil {
+		log.Printf("Scheduled run of %s %s: %v", schedule.Name, status, err)
+	}
+	err = finishScheduledRun(scheduledRunID, runID, status, err)
+	if err != nil {
+		log.Printf("Error recording a run of schedule %s: %v", schedule.Name, err)
+	}
+}
+
+// Runs the simulations of a schedule.
+func runScheduleSimulations(schedule Schedule) (int64, ScheduledRunStatus, error) {
+	opts, err := schedule.SimulationOptions()
+	if err != nil {
+		return 0, ScheduledRunFailed, err
+	}
+
+	var scenario *Scenario
+	if schedule.ScenarioID != 0 {
+		scenario, err = scenarioByID(schedule.ScenarioID)
+		if err != nil {
+			return 0, ScheduledRunFailed, err
+		}
+		if scenario == nil {
+			return 0, ScheduledRunFailed, fmt.Errorf("scenario %d not found", schedule.ScenarioID)
+		}
+	}
+
+	runID, ran, err := trySimulateAll(opts, scenario)
+	if !ran {
+		return 0, ScheduledRunSkipped, fmt.Errorf("another simulation was in progress")
+	}
+	if err != nil {
+		return 0, ScheduledRunFailed, err
+	}
+	return runID, ScheduledRunSucceeded, nil
+}
+
+// What a schedule runs, for the UI: "All scenarios" or the scenario's label.
+func scheduleTarget(schedule Schedule, scenarios []Scenario) string {
+	if schedule.ScenarioID == 0 {
+		return "All scenarios"
+	}
+	for _, scenario := range scenarios {
+		if scenario.ID == schedule.ScenarioID {
+			return scenario.Label()
+		}
+	}
+	return fmt.Sprintf("Scenario #%d", schedule.ScenarioID)
+}
+
+func nextRunAt(schedule Schedule, upcoming []UpcomingRun) string {
+	for _, run := range upcoming {
+		if run.Schedule.ID == schedule.ID {
+			return run.At.Format(time.RFC1123)
+		}
+	}
+	return ""
+}
+
+func scheduledRunStatusClass(status ScheduledRunStatus) string {
+	switch status {
+	case ScheduledRunSucceeded:
+		return "bg-green-50 text-green-700 dark:bg-green-900 dark:text-green-200"
+	case ScheduledRunFailed:
+		return "bg-red-50 text-red-700 dark:bg-red-900 dark:text-red-200"
+	case ScheduledRunSkipped:
+		return "bg-yellow-50 text-yellow-700 dark:bg-yellow-900 dark:text-yellow-200"
+	}
+	return "bg-gray-50 text-gray-600 dark:bg-gray-800 dark:text-gray-300"
+}
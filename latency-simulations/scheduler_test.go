@@ -0,0 +1,157 @@
+package latency_simulations
+
+import (
+	"fmt"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestScheduleValidate(t *testing.T) {
+	for _, tt := range []struct {
+		name     string
+		schedule Schedule
+		valid    bool
+	}{
+		{"cron", Schedule{Name: "a", Cron: "*/15 * * * *"}, true},
+		{"descriptor", Schedule{Name: "a", Cron: "@hourly"}, true},
+		{"every", Schedule{Name: "a", Cron: "@every 30m", JitterSeconds: maxJitterSeconds}, true},
+		{"no name", Schedule{Name: " ", Cron: "@hourly"}, false},
+		{"seconds field", Schedule{Name: "a", Cron: "0 */15 * * * *"}, false},
+		{"invalid cron", Schedule{Name: "a", Cron: "every day"}, false},
+		{"negative jitter", Schedule{Name: "a", Cron: "@hourly", JitterSeconds: -1}, false},
+		{"long jitter", Schedule{Name: "a", Cron: "@hourly", JitterSeconds: maxJitterSeconds + 1}, false},
+		{"unknown scenario", Schedule{Name: "a", Cron: "@hourly", ScenarioID: -1}, false},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			err := tt.schedule.setSimulationOptions(newSimulationOptions())
+			if err != nil {
+				t.Fatal(err)
+			}
+			err = tt.schedule.validate()
+			if (err == nil) != tt.valid {
+				t.Errorf("validate() = %v, want valid %v", err, tt.valid)
+			}
+		})
+	}
+}
+
+func TestScheduleSimulationOptions(t *testing.T) {
+	opts := newSimulationOptions()
+	opts.Products = 500
+	opts.KeyDistribution = Zipfian
+	s := Schedule{}
+	err := s.setSimulationOptions(opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	got, err := s.SimulationOptions()
+	if err != nil {
+		t.Fatal(err)
+	}
+	// the defaults are filled in, except for the seed
+	if got.Products != 500 || got.KeyDistribution != Zipfian || got.Queries != defaultQueryCount || got.Seed != 0 {
+		t.Errorf("SimulationOptions() = %+v", got)
+	}
+
+	opts.ZipfianSkew = 0.5
+	if err := s.setSimulationOptions(opts); err == nil {
+		t.Errorf("setSimulationOptions() accepted an invalid skew")
+	}
+}
+
+func TestScheduleNext(t *testing.T) {
+	now := time.Date(2024, 5, 1, 10, 7, 30, 0, time.UTC)
+	for _, tt := range []struct {
+		cron string
+		want time.Time
+	}{
+		{"*/15 * * * *", time.Date(2024, 5, 1, 10, 15, 0, 0, time.UTC)},
+		{"@hourly", time.Date(2024, 5, 1, 11, 0, 0, 0, time.UTC)},
+		{"0 3 * * 1", time.Date(2024, 5, 6, 3, 0, 0, 0, time.UTC)},
+		{"invalid", time.Time{}},
+	} {
+		if got := (Schedule{Cron: tt.cron}).Next(now); !got.Equal(tt.want) {
+			t.Errorf("Next() of %q = %v, want %v", tt.cron, got, tt.want)
+		}
+	}
+}
+
+// Creates a schedule without jitter, whose runs use the given options.
+func createTestSchedule(t *testing.T, opts SimulationOptions) *Schedule {
+	t.Helper()
+	s := &Schedule{Name: fmt.Sprintf("test-%d", time.Now().UnixNano()), Cron: "@hourly", Enabled: true}
+	err := s.setSimulationOptions(newSimulationOptions())
+	if err == nil {
+		err = createSchedule(s)
+	}
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { deleteSchedule(s.ID) })
+
+	// stored as is, so runs can start with options that no longer validate
+	options := fmt.Sprintf(`{"Products": %d, "Queries": %d, "ZipfianSkew": %g, "Seed": %d}`, opts.Products, opts.Queries, opts.ZipfianSkew, opts.Seed)
+	_, err = db.Exec(`UPDATE schedules SET options = ? WHERE id = ?`, options, s.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return s
+}
+
+// Returns the runs of the schedule, newest first.
+func scheduledRunsOf(t *testing.T, scheduleID int) []ScheduledRun {
+	t.Helper()
+	runs, err := listScheduledRuns()
+	if err != nil {
+		t.Fatal(err)
+	}
+	result := []ScheduledRun{}
+	for _, run := range runs {
+		if run.ScheduleID == scheduleID {
+			result = append(result, run)
+		}
+	}
+	return result
+}
+
+func TestRunScheduleSkipsWhileSimulating(t *testing.T) {
+	s := createTestSchedule(t, newSimulationOptions())
+
+	allLock.Lock()
+	runSchedule(s.ID)
+	allLock.Unlock()
+
+	runs := scheduledRunsOf(t, s.ID)
+	if len(runs) != 1 || runs[0].Status != ScheduledRunSkipped || runs[0].RunID.Valid || !runs[0].FinishedAt.Valid {
+		t.Errorf("scheduled runs = %+v, want a single finished skipped one", runs)
+	}
+}
+
+func TestRunScheduleRecordsFailures(t *testing.T) {
+	opts := newSimulationOptions()
+	opts.ZipfianSkew = 0.5 // invalid, the run fails before touching any db
+	opts.Seed = 1
+	s := createTestSchedule(t, opts)
+
+	runSchedule(s.ID)
+
+	runs := scheduledRunsOf(t, s.ID)
+	if len(runs) != 1 || runs[0].Status != ScheduledRunFailed || !strings.Contains(runs[0].Error, "skew") {
+		t.Errorf("scheduled runs = %+v, want a single failed one mentioning the skew", runs)
+	}
+}
+
+func TestRunScheduleIgnoresDisabledSchedules(t *testing.T) {
+	s := createTestSchedule(t, newSimulationOptions())
+	err := setScheduleEnabled(s.ID, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	runSchedule(s.ID)
+
+	if runs := scheduledRunsOf(t, s.ID); len(runs) != 0 {
+		t.Errorf("a disabled schedule ran: %+v", runs)
+	}
+}
@@ -0,0 +1,105 @@
+package latency_simulations
+
+import (
+	"context"
+	"strings"
+	"unicode"
+
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	semconv "go.opentelemetry.io/otel/semconv/v1.21.0"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// Runs are traced when tracing is configured (see common/tracing.go), so a
+// slow run can be inspected in e.g. Jaeger: a run has a span per scenario,
+// which has spans for its baselines, its setup (with the seed, if the
+// dataset isn't reused) and each workload, which has a span per SQL
+// statement it sends. Cache commands are only traced as part of their
+// workload.
+//
+// Query spans are started inside the measured operations, so they add a
+// little to the measured latency when tracing is on. Without a configured
+// exporter, they cost next to nothing.
+
+var tracer = otel.Tracer("go-on-rails/latency-simulations")
+
+var (
+	scenarioAttribute = attribute.Key("simulation.scenario")
+	workloadAttribute = attribute.Key("simulation.workload")
+)
+
+// Spans of a scenario, and everything in it, are tagged with its label.
+type scenarioContextKey struct{}
+
+// Starts the span of a scenario, e.g. SameBox/pgx.
+func startScenario(ctx context.Context, label string) (context.Context, trace.Span) {
+	ctx = context.WithValue(ctx, scenarioContextKey{}, label)
+	return tracer.Start(ctx, "scenario "+label, trace.WithAttributes(scenarioAttribute.String(label)))
+}
+
+// Starts a span tagged with the scenario of the context, if any.
+func startSpan(ctx context.Context, name string, attributes ...attribute.KeyValue) (context.Context, trace.Span) {
+	if label, ok := ctx.Value(scenarioContextKey{}).(string); ok {
+		attributes = append(attributes, scenarioAttribute.String(label))
+	}
+	return tracer.Start(ctx, name, trace.WithAttributes(attributes...))
+}
+
+// Starts the span of a SQL statement, named after its operation like
+// database client spans usually are, e.g. SELECT. The attributes are only
+// built when the span is recorded, as this runs inside measured operations.
+func startQuery(ctx context.Context, driverName string, query string, attributes ...attribute.KeyValue) (context.Context, trace.Span) {
+	query = strings.TrimSpace(query)
+	end := strings.IndexFunc(query, unicode.IsSpace)
+	if end < 0 {
+		end = len(query)
+	}
+	operation := strings.ToUpper(query[:end])
+
+	ctx, span := tracer.Start(ctx, operation, trace.WithSpanKind(trace.SpanKindClient))
+	if span.IsRecording() {
+		if label, ok := ctx.Value(scenarioContextKey{}).(string); ok {
+			attributes = append(attributes, scenarioAttribute.String(label))
+		}
+		span.SetAttributes(attributes...)
+		span.SetAttributes(
+			dbSystem(driverName),
+			semconv.DBOperation(operation),
+			semconv.DBStatement(strings.Join(strings.Fields(query), " ")),
+		)
+	}
+	return ctx, span
+}
+
+// The db.system attribute of a database/sql driver.
+func dbSystem(driverName string) attribute.KeyValue {
+	if driverName == "postgres" || driverName == "pgx" {
+		return semconv.DBSystemPostgreSQL
+	}
+	return semconv.DBSystemSqlite
+}
+
+// Starts the span of a SQL statement sent by the running workload.
+func (t *target) startQuery(query string, attributes ...attribute.KeyValue) (context.Context, trace.Span) {
+	return startQuery(t.context(), t.db.DriverName(), query, append(attributes, workloadAttribute.String(t.workload))...)
+}
+
+// The trace context of the running workload, or of the scenario between
+// workloads.
+func (t *target) context() context.Context {
+	if t.ctx == nil {
+		return context.Background()
+	}
+	return t.ctx
+}
+
+// Records the error, if any, and ends the span.
+func endSpan(span trace.Span, err error) {
+	if err != nil {
+		span.RecordError(err)
+		span.SetStatus(codes.Error, err.Error())
+	}
+	span.End()
+}
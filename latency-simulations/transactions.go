@@ -0,0 +1,235 @@
+package latency_simulations
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+	"sync"
+
+	"github.com/jackc/pgx/v5/pgconn"
+	"github.com/jmoiron/sqlx"
+	"github.com/lib/pq"
+	"github.com/mattn/go-sqlite3"
+)
+
+// Transaction workloads run a read-modify-write transaction like a real
+// handler would: BEGIN, a number of statements, COMMIT. Every statement is
+// a round trip, so these show how transactions add up over long links.
+//
+// The main workload of each mode runs one transaction at a time on a product
+// picked with the key distribution. Its Contended variant runs a few of them
+// at once on a small set of hot products, like concurrent requests updating
+// the same rows would. Under Repeatable Read and Serializable they conflict,
+// and the transactions that fail are retried. The operation's latency is then
+// that of the slowest one.
+
+const (
+	defaultTxStatements = 3
+	maxTxStatements     = 50
+
+	// How many times an operation is retried after a serialization failure.
+	maxRetries = 3
+
+	// Transactions run at once by each operation of the Contended workloads,
+	// and the number of products they pick from.
+	txConcurrency = 4
+	txHotProducts = 4
+)
+
+// The isolation level or locking mode a transaction is started with.
+type txMode struct {
+	name  string
+	begin string
+}
+
+var postgresTxModes = []txMode{
+	{"ReadCommitted", "BEGIN ISOLATION LEVEL READ COMMITTED"},
+	{"RepeatableRead", "BEGIN ISOLATION LEVEL REPEATABLE READ"},
+	{"Serializable", "BEGIN ISOLATION LEVEL SERIALIZABLE"},
+}
+
+var sqliteTxModes = []txMode{
+	{"Deferred", "BEGIN DEFERRED"},
+	{"Immediate", "BEGIN IMMEDIATE"},
+}
+
+// Returns a single and a contended transaction workload per mode the db
+// supports. If the options ask for a specific isolation level, only the
+// workloads of that one are returned.
+func transactionWorkloads(t *target, opts SimulationOptions) []workload {
+	modes := sqliteTxModes
+	if isPostgres(t.db) {
+		modes = postgresTxModes
+	}
+
+	result := []workload{}
+	for _, mode := range modes {
+		if opts.TxIsolation != "" && !strings.EqualFold(opts.TxIsolation, mode.name) {
+			continue
+		}
+		result = append(result, workload{
+			name:  "Tx" + mode.name,
+			run:   singleTransaction(mode, opts.TxStatements),
+			args:  txProductID,
+			keyed: true,
+		}, workload{
+			name: "Tx" + mode.name + "Contended",
+			run:  concurrentTransactions(mode, opts.TxStatements),
+			args: hotProductIDs,
+		})
+	}
+	return result
+}
+
+// Checks that the isolation level is one of a db, or empty for all of them.
+func validTxIsolation(isolation string) error {
+	if isolation == "" {
+		return nil
+	}
+	names := []string{}
+	for _, mode := range append(append([]txMode{}, postgresTxModes...), sqliteTxModes...) {
+		if strings.EqualFold(isolation, mode.name) {
+			return nil
+		}
+		names = append(names, mode.name)
+	}
+	return fmt.Errorf("unknown transaction isolation %q, use one of %s", isolation, strings.Join(names, ", "))
+}
+
+// Picks the product of the transaction with the workload's key distribution.
+// Product ids start at 1 where the keys start at 0.
+func txProductID(t *target, i int) []any {
+	return []any{1 + t.pickKey()}
+}
+
+// Runs a single transaction on the product of target.args. Serialization
+// failures are retried by measureWorkload.
+func singleTransaction(mode txMode, statements int) func(t *target, i int) error {
+	return func(t *target, i int) error {
+		return transaction(t, mode, t.args[0].(int), statements)
+	}
+}
+
+// Picks the product of each concurrent transaction among the hot ones.
+// They're drawn up front, as the random source isn't safe for concurrent use.
+func hotProductIDs(t *target, i int) []any {
+	hot := min(txHotProducts, t.products)
+	ids := make([]any, txConcurrency)
+	for k := range ids {
+		ids[k] = 1 + t.rng.Intn(hot)
+	}
+	return ids
+}
+
+// Runs a transaction per product of target.args at once, each one retried
+// on its own with the same product after a serialization failure.
+func concurrentTransactions(mode txMode, statements int) func(t *target, i int) error {
+	return func(t *target, i int) error {
+		errs := make([]error, len(t.args))
+		retries := make([]int, len(t.args))
+		var wg sync.WaitGroup
+		for k, productID := range t.args {
+			wg.Add(1)
+			go func(k int, productID int) {
+				defer wg.Done()
+				errs[k] = transaction(t, mode, productID, statements)
+				for ; retries[k] < maxRetries && isSerializationFailure(errs[k]); retries[k]++ {
+					errs[k] = transaction(t, mode, productID, statements)
+				}
+			}(k, productID.(int))
+		}
+		wg.Wait()
+
+		for k := range retries {
+			t.retries += retries[k]
+		}
+		for _, err := range errs {
+			if isSerializationFailure(err) {
+				// already retried, the operation as a whole isn't
+				return fmt.Errorf("still conflicting after %d retries: %v", maxRetries, err)
+			}
+		}
+		return errors.Join(errs...)
+	}
+}
+
+// Runs a whole transaction with the given number of statements. The begin
+// and commit are sent as plain statements on a dedicated connection, because
+// database/sql can't start SQLite transactions in IMMEDIATE mode.
+func transaction(t *target, mode txMode, productID int, statements int) error {
+	conn, err := t.db.Connx(t.context())
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+
+	err = execTraced(t, conn, mode.begin)
+	if err != nil {
+		return err
+	}
+
+	err = readModifyWrite(t, conn, productID, statements)
+	if err == nil {
+		err = execTraced(t, conn, `COMMIT`)
+	}
+	if err != nil {
+		// a failed COMMIT leaves SQLite transactions open, so always roll back
+		execTraced(t, conn, `ROLLBACK`)
+		return err
+	}
+	return nil
+}
+
+// Runs the statements of a transaction. They cycle through reading the
+// product's price, updating it and adding a review for that product.
+func readModifyWrite(t *target, conn *sqlx.Conn, productID int, statements int) error {
+	var price float64
+	for s := 0; s < statements; s++ {
+		var err error
+		switch s % 3 {
+		case 0:
+			query := conn.Rebind(`SELECT price FROM products WHERE id = ?`)
+			ctx, span := t.startQuery(query)
+			err = conn.QueryRowxContext(ctx, query, productID).Scan(&price)
+			endSpan(span, err)
+		case 1:
+			err = execTraced(t, conn, conn.Rebind(`UPDATE products SET price = ? WHERE id = ?`), price*1.01, productID)
+		case 2:
+			err = execTraced(t, conn, conn.Rebind(`INSERT INTO product_reviews (product_id, review) VALUES (?, ?)`), productID, fmt.Sprintf("review%d", s))
+		}
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Executes a statement of a transaction on its connection, in a query span.
+func execTraced(t *target, conn *sqlx.Conn, query string, args ...any) error {
+	ctx, span := t.startQuery(query)
+	_, err := conn.ExecContext(ctx, query, args...)
+	endSpan(span, err)
+	return err
+}
+
+// Reports whether the operation failed because of a conflict with another
+// transaction and is safe to retry: serialization failures & deadlocks in
+// Postgres, busy or locked databases in SQLite.
+func isSerializationFailure(err error) bool {
+	var pqErr *pq.Error
+	if errors.As(err, &pqErr) {
+		return pqErr.Code == "40001" || pqErr.Code == "40P01"
+	}
+
+	var pgErr *pgconn.PgError
+	if errors.As(err, &pgErr) {
+		return pgErr.Code == "40001" || pgErr.Code == "40P01"
+	}
+
+	var sqliteErr sqlite3.Error
+	if errors.As(err, &sqliteErr) {
+		return sqliteErr.Code == sqlite3.ErrBusy || sqliteErr.Code == sqlite3.ErrLocked
+	}
+
+	return false
+}
@@ -0,0 +1,62 @@
+package latency_simulations
+
+import (
+	"context"
+	"testing"
+)
+
+func TestValidateTxIsolation(t *testing.T) {
+	for _, tt := range []struct {
+		isolation string
+		valid     bool
+	}{
+		{"", true},
+		{"Serializable", true},
+		{"readcommitted", true},
+		{"Immediate", true},
+		{"Snapshot", false},
+		{"Serializable ", false},
+	} {
+		opts := newSimulationOptions()
+		opts.TxIsolation = tt.isolation
+		err := opts.validate()
+		if (err == nil) != tt.valid {
+			t.Errorf("validate() with isolation %q = %v, want valid %v", tt.isolation, err, tt.valid)
+		}
+	}
+}
+
+// Each mode has a single transaction workload and a contended one, and both
+// run against a seeded SQLite db.
+func TestTransactionWorkloads(t *testing.T) {
+	opts := testSimulationOptions(t)
+	db := openSeededSQLite(t, opts)
+
+	tg := &target{db: db, products: opts.Products, ctx: context.Background()}
+	names := []string{}
+	for _, w := range transactionWorkloads(tg, opts) {
+		names = append(names, w.name)
+		stats, err := measureWorkload(tg, w, opts)
+		if err != nil {
+			t.Fatalf("%s: %v", w.name, err)
+		}
+		if stats.Count != float64(opts.Queries) {
+			t.Errorf("%s ran %g transactions, want %d", w.name, stats.Count, opts.Queries)
+		}
+	}
+	want := []string{"TxDeferred", "TxDeferredContended", "TxImmediate", "TxImmediateContended"}
+	if len(names) != len(want) {
+		t.Fatalf("workloads = %v, want %v", names, want)
+	}
+	for i := range want {
+		if names[i] != want[i] {
+			t.Errorf("workloads = %v, want %v", names, want)
+		}
+	}
+
+	opts.TxIsolation = "immediate"
+	ws := transactionWorkloads(tg, opts)
+	if len(ws) != 2 || ws[0].name != "TxImmediate" || ws[1].name != "TxImmediateContended" {
+		t.Errorf("workloads of the Immediate mode = %d workloads, want TxImmediate and TxImmediateContended", len(ws))
+	}
+}
@@ -0,0 +1,442 @@
+package latency_simulations
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"database/sql"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"go-on-rails/common"
+	"io"
+	"log"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/jmoiron/sqlx"
+)
+
+// Webhooks POST a JSON payload when a simulation run completes or fails, for
+// chatops and dashboards. They're managed by admins and stored in the app's
+// SQLite db, and every delivery attempt is logged with the response.
+//
+// When a webhook has a secret, deliveries are signed: the X-Latency-Signature
+// header is "sha256=" followed by the hex HMAC-SHA256 of
+// "<X-Latency-Timestamp>.<body>" keyed with the secret. Receivers should
+// recompute it and reject old timestamps.
+//
+// Deliveries are jobs of the webhooks queue (see common/queue.go), so they
+// survive restarts and show up on the jobs page. Failed deliveries (network
+// errors, 429 and 5xx responses) are retried with the queue's backoff, and
+// end up dead on the jobs page once they run out of attempts.
+
+type Webhook struct {
+	ID   int    `db:"id" form:"-"`
+	Name string `db:"name" form:"name"`
+	URL  string `db:"url" form:"url"`
+
+	// Only set when creating a webhook or rotating its secret; it's stored
+	// encrypted.
+	Secret          string `db:"-" form:"secret"`
+	EncryptedSecret string `db:"encrypted_secret" form:"-"`
+
+	// Which events are delivered.
+	OnSuccess bool `db:"on_success" form:"on_success"`
+	OnFailure bool `db:"on_failure" form:"on_failure"`
+
+	Enabled   bool      `db:"enabled" form:"enabled"`
+	CreatedAt time.Time `db:"created_at" form:"-"`
+}
+
+type WebhookEvent string
+
+const (
+	RunCompleted WebhookEvent = "run.completed"
+	RunFailed    WebhookEvent = "run.failed"
+	WebhookPing  WebhookEvent = "ping" // sent by the "Send test" button
+)
+
+// A delivery attempt, for the delivery log.
+type WebhookDelivery struct {
+	ID          int           `db:"id"`
+	WebhookID   int           `db:"webhook_id"`
+	WebhookName string        `db:"webhook_name"`
+	Event       WebhookEvent  `db:"event"`
+	RunID       sql.NullInt64 `db:"run_id"`
+	Attempt     int           `db:"attempt"`
+	StatusCode  int           `db:"status_code"` // 0 when no response was received
+	Response    string        `db:"response"`    // the body, truncated
+	Error       string        `db:"error"`
+	Duration    float64       `db:"duration"` // in nanoseconds
+	CreatedAt   time.Time     `db:"created_at"`
+}
+
+func (d WebhookDelivery) Succeeded() bool {
+	return d.Error == "" && d.StatusCode >= 200 && d.StatusCode < 300
+}
+
+// The JSON body of a delivery.
+type webhookPayload struct {
+	Event      WebhookEvent        `json:"event"`
+	RunID      int64               `json:"run_id,omitempty"`
+	Status     string              `json:"status"` // "succeeded" or "failed"
+	Error      string              `json:"error,omitempty"`
+	ResultsURL string              `json:"results_url"`
+	Labels     []webhookLabelStats `json:"labels"`
+	SentAt     time.Time           `json:"sent_at"`
+}
+
+// Latencies are in milliseconds, unlike LatencyStats.
+type webhookLabelStats struct {
+	Label         string  `json:"label"`
+	Scenario      string  `json:"scenario"`
+	Workload      string  `json:"workload"`
+	MedianMs      float64 `json:"median_ms"`
+	P10Ms         float64 `json:"p10_ms"`
+	P25Ms         float64 `json:"p25_ms"`
+	P75Ms         float64 `json:"p75_ms"`
+	P90Ms         float64 `json:"p90_ms"`
+	P95Ms         float64 `json:"p95_ms"`
+	Count         float64 `json:"count"`
+	BaselineRatio float64 `json:"baseline_ratio"`
+}
+
+const (
+	webhookMaxAttempts = 5
+
+	// How much of a response body the delivery log keeps.
+	webhookResponseLimit = 1024
+
+	// How many deliveries the delivery log lists.
+	webhookDeliveriesListed = 100
+)
+
+var webhookClient = &http.Client{Timeout: webhookTimeout}
+
+var webhookQueue = newWebhookQueue()
+
+const deliverWebhookJob = "deliver_webhook"
+
+// The payload of a delivery job.
+type webhookJob struct {
+	WebhookID int            `json:"webhook_id"`
+	Payload   webhookPayload `json:"payload"`
+}
+
+func newWebhookQueue() *common.Queue {
+	queue := common.NewQueue("webhooks", 2)
+	queue.Handle(deliverWebhookJob, common.JobOptions{MaxAttempts: webhookMaxAttempts}, func(queued common.Job) error {
+		var job webhookJob
+		err := json.Unmarshal([]byte(queued.Payload), &job)
+		if err != nil {
+			return err
+		}
+		return deliverJob(job, queued.Attempts, queued.MaxAttempts)
+	})
+	return queue
+}
+
+func createWebhooksTables(db sqlx.Execer) error {
+	_, err := db.Exec(`CREATE TABLE IF NOT EXISTS webhooks (
+			id INTEGER PRIMARY KEY AUTOINCREMENT,
+			name TEXT NOT NULL UNIQUE,
+			url TEXT NOT NULL,
+			encrypted_secret TEXT NOT NULL DEFAULT '',
+			on_success BOOLEAN NOT NULL DEFAULT TRUE,
+			on_failure BOOLEAN NOT NULL DEFAULT TRUE,
+			enabled BOOLEAN NOT NULL DEFAULT TRUE,
+			created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP
+		)`)
+	if err != nil {
+		return err
+	}
+
+	_, err = db.Exec(`CREATE TABLE IF NOT EXISTS webhook_deliveries (
+			id INTEGER PRIMARY KEY AUTOINCREMENT,
+			webhook_id INTEGER NOT NULL REFERENCES webhooks (id) ON DELETE CASCADE,
+			event TEXT NOT NULL,
+			run_id INTEGER REFERENCES simulation_runs (id),
+			attempt INTEGER NOT NULL,
+			status_code INTEGER NOT NULL DEFAULT 0,
+			response TEXT NOT NULL DEFAULT '',
+			error TEXT NOT NULL DEFAULT '',
+			duration REAL NOT NULL DEFAULT 0,
+			created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP
+		)`)
+	return err
+}
+
+func (w *Webhook) validate() error {
+	w.Name = strings.TrimSpace(w.Name)
+	if w.Name == "" {
+		return fmt.Errorf("a name is required")
+	}
+	u, err := url.Parse(w.URL)
+	if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+		return fmt.Errorf("invalid webhook URL %q", w.URL)
+	}
+	if !w.OnSuccess && !w.OnFailure {
+		return fmt.Errorf("a webhook needs at least one event")
+	}
+	return nil
+}
+
+func (w Webhook) Signed() bool {
+	return w.EncryptedSecret != ""
+}
+
+func (w Webhook) wants(event WebhookEvent) bool {
+	switch event {
+	case RunCompleted:
+		return w.OnSuccess
+	case RunFailed:
+		return w.OnFailure
+	}
+	return true
+}
+
+func listWebhooks() ([]Webhook, error) {
+	webhooks := []Webhook{}
+	err := db.Select(&webhooks, `SELECT * FROM webhooks ORDER BY name`)
+	return webhooks, err
+}
+
+// Returns the webhook with the given id, or nil if there's none.
+func webhookByID(id int) (*Webhook, error) {
+	var webhook Webhook
+	err := db.Get(&webhook, `SELECT * FROM webhooks WHERE id = ?`, id)
+	if err == sql.ErrNoRows {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	return &webhook, nil
+}
+
+func createWebhook(w *Webhook) error {
+	err := w.validate()
+	if err != nil {
+		return err
+	}
+	if w.Secret != "" {
+		w.EncryptedSecret, err = common.Encrypt(w.Secret)
+		if err != nil {
+			return err
+		}
+	}
+	result, err := db.NamedExec(`
+		INSERT INTO webhooks (name, url, encrypted_secret, on_success, on_failure, enabled)
+		VALUES (:name, :url, :encrypted_secret, :on_success, :on_failure, :enabled)
+	`, w)
+	if err != nil {
+		return err
+	}
+	id, err := result.LastInsertId()
+	w.ID = int(id)
+	return err
+}
+
+func setWebhookEnabled(id int, enabled bool) error {
+	_, err := db.Exec(`UPDATE webhooks SET enabled = ? WHERE id = ?`, enabled, id)
+	return err
+}
+
+// Replaces the signing secret of a webhook, e.g. to rotate it. An empty
+// secret stops signing its deliveries.
+func setWebhookSecret(id int, secret string) error {
+	encrypted := ""
+	if secret != "" {
+		var err error
+		encrypted, err = common.Encrypt(secret)
+		if err != nil {
+			return err
+		}
+	}
+	_, err := db.Exec(`UPDATE webhooks SET encrypted_secret = ? WHERE id = ?`, encrypted, id)
+	return err
+}
+
+func deleteWebhook(id int) error {
+	_, err := db.Exec(`DELETE FROM webhooks WHERE id = ?`, id)
+	return err
+}
+
+// Returns the most recent delivery attempts, newest first.
+func listWebhookDeliveries() ([]WebhookDelivery, error) {
+	deliveries := []WebhookDelivery{}
+	err := db.Select(&deliveries, `
+		SELECT d.id, d.webhook_id, w.name AS webhook_name, d.event, d.run_id, d.attempt,
+			d.status_code, d.response, d.error, d.duration, d.created_at
+		FROM webhook_deliveries d JOIN webhooks w ON w.id = d.webhook_id
+		ORDER BY d.id DESC LIMIT ?
+	`, webhookDeliveriesListed)
+	return deliveries, err
+}
+
+// Tells the enabled webhooks that a run completed, or failed when runErr is
+// set. Deliveries are queued; errors are logged.
+func deliverRunWebhooks(runID int64, runErr error) {
+	webhooks, err := listWebhooks()
+	if err != nil {
+		log.Printf("Error loading webhooks: %v", err)
+		return
+	}
+
+	payload := webhookPayload{Event: RunCompleted, RunID: runID, Status: "succeeded", ResultsURL: common.Env.BASE_URL + "/", Labels: []webhookLabelStats{}}
+	if runErr != nil {
+		payload.Event, payload.Status, payload.Error = RunFailed, "failed", runErr.Error()
+	} else {
+		payload.Labels, err = runLabelStats(runID)
+		if err != nil {
+			log.Printf("Error loading the results of run %d for webhooks: %v", runID, err)
+			return
+		}
+	}
+
+	for _, webhook := range webhooks {
+		if webhook.Enabled && webhook.wants(payload.Event) {
+			err = webhookQueue.Add(deliverWebhookJob, "", webhookJob{WebhookID: webhook.ID, Payload: payload})
+			if err != nil {
+				log.Printf("Error queueing a delivery of webhook %s: %v", webhook.Name, err)
+				errorsTotal.WithLabelValues("webhook").Inc()
+			}
+		}
+	}
+}
+
+// Returns the latency logs of a run, for the payload.
+func runLabelStats(runID int64) ([]webhookLabelStats, error) {
+	var logs []LatencyLog
+	err := db.Select(&logs, `SELECT * FROM latency_logs WHERE run_id = ? ORDER BY label`, runID)
+	if err != nil {
+		return nil, err
+	}
+	ms := float64(time.Millisecond)
+	labels := make([]webhookLabelStats, len(logs))
+	for i, l := range logs {
+		labels[i] = webhookLabelStats{
+			Label:         l.Label,
+			Scenario:      l.Scenario,
+			Workload:      l.Workload,
+			MedianMs:      l.MedianLatency / ms,
+			P10Ms:         l.P10Latency / ms,
+			P25Ms:         l.P25Latency / ms,
+			P75Ms:         l.P75Latency / ms,
+			P90Ms:         l.P90Latency / ms,
+			P95Ms:         l.P95Latency / ms,
+			Count:         l.Count,
+			BaselineRatio: l.BaselineRatio,
+		}
+	}
+	return labels, nil
+}
+
+// Makes a delivery attempt of a queued job. Returns an error when the
+// attempt should be retried. Deliveries of deleted or disabled webhooks are
+// dropped.
+func deliverJob(job webhookJob, attempt int, maxAttempts int) error {
+	webhook, err := webhookByID(job.WebhookID)
+	if err != nil {
+		return err
+	}
+	if webhook == nil || !webhook.Enabled {
+		return nil
+	}
+
+	delivery, retry := deliver(*webhook, job.Payload, attempt)
+	err = logWebhookDelivery(delivery)
+	if err != nil {
+		log.Printf("Error logging a delivery of webhook %s: %v", webhook.Name, err)
+	}
+	if !retry {
+		return nil
+	}
+	if attempt >= maxAttempts {
+		log.Printf("Giving up on delivering %s to webhook %s after %d attempts", job.Payload.Event, webhook.Name, attempt)
+		errorsTotal.WithLabelValues("webhook").Inc()
+	}
+	if delivery.Error != "" {
+		return fmt.Errorf("delivery %d failed: %s", attempt, delivery.Error)
+	}
+	return fmt.Errorf("delivery %d failed with status %d", attempt, delivery.StatusCode)
+}
+
+// Makes one delivery attempt and returns its log entry, and whether it
+// should be retried.
+func deliver(webhook Webhook, payload webhookPayload, attempt int) (WebhookDelivery, bool) {
+	delivery := WebhookDelivery{WebhookID: webhook.ID, Event: payload.Event, RunID: nullableID(int(payload.RunID)), Attempt: attempt}
+
+	payload.SentAt = time.Now().UTC()
+	body, err := json.Marshal(payload)
+	if err != nil {
+		delivery.Error = err.Error()
+		return delivery, false
+	}
+	req, err := http.NewRequest(http.MethodPost, webhook.URL, bytes.NewReader(body))
+	if err != nil {
+		delivery.Error = err.Error()
+		return delivery, false
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("User-Agent", "latency-simulations-webhooks")
+	req.Header.Set("X-Latency-Event", string(payload.Event))
+	if webhook.Signed() {
+		secret, err := common.Decrypt(webhook.EncryptedSecret)
+		if err != nil {
+			delivery.Error = err.Error()
+			return delivery, false
+		}
+		timestamp := strconv.FormatInt(payload.SentAt.Unix(), 10)
+		req.Header.Set("X-Latency-Timestamp", timestamp)
+		req.Header.Set("X-Latency-Signature", "sha256="+signWebhook(secret, timestamp, body))
+	}
+
+	start := time.Now()
+	resp, err := webhookClient.Do(req)
+	delivery.Duration = float64(time.Since(start))
+	if err != nil {
+		delivery.Error = err.Error()
+		return delivery, true
+	}
+	defer resp.Body.Close()
+
+	delivery.StatusCode = resp.StatusCode
+	response, _ := io.ReadAll(io.LimitReader(resp.Body, webhookResponseLimit))
+	delivery.Response = string(response)
+	if delivery.Succeeded() {
+		return delivery, false
+	}
+	return delivery, resp.StatusCode == http.StatusTooManyRequests || resp.StatusCode >= 500
+}
+
+func signWebhook(secret, timestamp string, body []byte) string {
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write([]byte(timestamp + "."))
+	mac.Write(body)
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+func logWebhookDelivery(d WebhookDelivery) error {
+	_, err := db.NamedExec(`
+		INSERT INTO webhook_deliveries (webhook_id, event, run_id, attempt, status_code, response, error, duration)
+		VALUES (:webhook_id, :event, :run_id, :attempt, :status_code, :response, :error, :duration)
+	`, d)
+	return err
+}
+
+// Sends a single ping delivery, without retries, so the outcome can be
+// shown right away.
+func testWebhook(webhook Webhook) WebhookDelivery {
+	payload := webhookPayload{Event: WebhookPing, Status: "succeeded", ResultsURL: common.Env.BASE_URL + "/", Labels: []webhookLabelStats{}}
+	delivery, _ := deliver(webhook, payload, 1)
+	err := logWebhookDelivery(delivery)
+	if err != nil {
+		log.Printf("Error logging a delivery of webhook %s: %v", webhook.Name, err)
+	}
+	return delivery
+}
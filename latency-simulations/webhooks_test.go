@@ -0,0 +1,113 @@
+package latency_simulations
+
+import (
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+// The expected signatures are the HMAC-SHA256 of "timestamp.body", as a
+// receiver would compute them, e.g. with Python's hmac module.
+func TestSignWebhook(t *testing.T) {
+	body := []byte(`{"event":"run.completed"}`)
+	tests := []struct {
+		name      string
+		secret    string
+		timestamp string
+		body      []byte
+		want      string
+	}{
+		{"payload", "secret", "1700000000", body, "db585ba57b4734bd5a56dd0e5182586998ea5241f4eabce8c5ce67cd61265595"},
+		{"other secret", "other", "1700000000", body, "fefe83da9519789330b9c67bf6e6a012e252d2992fb05e1776c49242581b44a0"},
+		{"other timestamp", "secret", "1700000001", body, "f47080e7354f81db6e9ae33aa67f053e8b8571e43f655f9b54466b6f58c3f785"},
+		{"empty body", "secret", "1700000000", nil, "4bc5f74d868b97888288889c5d9d65df02526f94c1592a79fdf4fe8b26e311e5"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := signWebhook(tt.secret, tt.timestamp, tt.body); got != tt.want {
+				t.Errorf("signWebhook() = %s, want %s", got, tt.want)
+			}
+		})
+	}
+}
+
+// A request received by a test webhook server.
+type receivedWebhook struct {
+	header http.Header
+	body   []byte
+}
+
+// Creates a webhook delivering to a server that answers with the given
+// status, and returns the requests it received.
+func createTestWebhook(t *testing.T, secret string, status int) (*Webhook, chan receivedWebhook) {
+	t.Helper()
+	requests := make(chan receivedWebhook, 10)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := io.ReadAll(r.Body)
+		requests <- receivedWebhook{r.Header, body}
+		w.WriteHeader(status)
+	}))
+	t.Cleanup(server.Close)
+
+	webhook := &Webhook{Name: fmt.Sprintf("test-%d", time.Now().UnixNano()), URL: server.URL, Secret: secret, OnSuccess: true, OnFailure: true, Enabled: true}
+	err := createWebhook(webhook)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { deleteWebhook(webhook.ID) })
+	return webhook, requests
+}
+
+// Returns the logged attempts of the webhook's deliveries, oldest first.
+func loggedAttempts(t *testing.T, webhookID int) []int {
+	t.Helper()
+	attempts := []int{}
+	err := db.Select(&attempts, `SELECT attempt FROM webhook_deliveries WHERE webhook_id = ? ORDER BY id`, webhookID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return attempts
+}
+
+// The attempt is the queue's, not a count of the logged deliveries, so it
+// restarts after a manual retry.
+func TestDeliverJobAttempts(t *testing.T) {
+	webhook, _ := createTestWebhook(t, "", http.StatusInternalServerError)
+	job := webhookJob{WebhookID: webhook.ID, Payload: webhookPayload{Event: WebhookPing}}
+
+	for _, attempt := range []int{1, 2, 1} {
+		if err := deliverJob(job, attempt, webhookMaxAttempts); err == nil {
+			t.Errorf("deliverJob() of attempt %d succeeded with a 500 response", attempt)
+		}
+	}
+	if got := loggedAttempts(t, webhook.ID); fmt.Sprint(got) != "[1 2 1]" {
+		t.Errorf("logged attempts = %v, want [1 2 1]", got)
+	}
+}
+
+func TestSetWebhookSecret(t *testing.T) {
+	webhook, requests := createTestWebhook(t, "old secret", http.StatusOK)
+	job := webhookJob{WebhookID: webhook.ID, Payload: webhookPayload{Event: WebhookPing}}
+
+	for _, secret := range []string{"new secret", ""} {
+		err := setWebhookSecret(webhook.ID, secret)
+		if err == nil {
+			err = deliverJob(job, 1, webhookMaxAttempts)
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+		req := <-requests
+		signature := req.header.Get("X-Latency-Signature")
+		want := ""
+		if secret != "" {
+			want = "sha256=" + signWebhook(secret, req.header.Get("X-Latency-Timestamp"), req.body)
+		}
+		if signature != want {
+			t.Errorf("signature with secret %q = %q, want %q", secret, signature, want)
+		}
+	}
+}
@@ -0,0 +1,495 @@
+package latency_simulations
+
+import (
+	"context"
+	"fmt"
+	"math/rand"
+	"time"
+
+	"github.com/jackc/pgx/v5"
+	"github.com/jackc/pgx/v5/pgxpool"
+	"github.com/jmoiron/sqlx"
+	"github.com/redis/go-redis/v9"
+)
+
+// The database the workloads run against.
+type target struct {
+	db *sqlx.DB
+
+	dsn string // empty for the app's own SQLite db
+
+	// Number of seeded products, see SimulationOptions.
+	products int
+
+	// Native pgx pool to the same database, for workloads that need Postgres
+	// features database/sql doesn't expose (e.g. COPY). Nil for SQLite.
+	pool *pgxpool.Pool
+
+	// When set, queries sent through the helpers below go through the pool
+	// instead of database/sql. See clients.go.
+	native bool
+
+	// When set, queries sent through the helpers below are prepared once
+	// and the statements are reused, see querymodes.go.
+	prepared bool
+	stmts    map[string]*sqlx.Stmt
+
+	// Random source of the running workload, derived from the run's seed,
+	// and picker of the next product of keyed workloads. Set for each workload.
+	rng     *rand.Rand
+	pickKey func() int
+
+	// Arguments of the running operation, for workloads drawing them with
+	// workload.args.
+	args []any
+
+	// Retries the running workload did itself, on top of the operations
+	// measureWorkload retries. See transactions.go.
+	retries int
+
+	// Reads of the running workload served by its cache, and reads that
+	// fell through to the database. See localcache.go and cache.go.
+	cacheHits   int
+	cacheMisses int
+
+	// Trace context & name of the running workload, see tracing.go. Queries
+	// sent outside of workloads, like the baselines, are traced in the
+	// scenario's context.
+	ctx      context.Context
+	workload string
+
+	// Cache in front of the database for the cache-aside workload, or the
+	// cache itself in the cache scenario. Nil when no cache is configured.
+	cache *redis.Client
+}
+
+// Returns the prepared statement for the query, preparing it on first use.
+func (t *target) stmt(query string) (*sqlx.Stmt, error) {
+	if stmt, ok := t.stmts[query]; ok {
+		return stmt, nil
+	}
+	stmt, err := t.db.Preparex(query)
+	if err != nil {
+		return nil, err
+	}
+	if t.stmts == nil {
+		t.stmts = map[string]*sqlx.Stmt{}
+	}
+	t.stmts[query] = stmt
+	return stmt, nil
+}
+
+// Closes the statements prepared for this target, if any.
+func (t *target) closeStmts() {
+	for _, stmt := range t.stmts {
+		stmt.Close()
+	}
+	t.stmts = nil
+}
+
+// Closes the connections of a Postgres target. The app's SQLite db is
+// shared, so it's never closed here.
+func (t *target) close() {
+	t.closeStmts()
+	if t.dsn == "" {
+		return
+	}
+	t.db.Close()
+	if t.pool != nil {
+		t.pool.Close()
+	}
+}
+
+// The helpers below rebind the query for the driver, prepare it when the
+// target is in prepared mode and send it through pgxpool for native targets.
+// Workloads should use them instead of t.db, so they can be measured with
+// every client and query mode.
+
+func queryOne[T any](t *target, query string, args ...any) (result T, err error) {
+	query = t.db.Rebind(query)
+	ctx, span := t.startQuery(query)
+	defer func() { endSpan(span, err) }()
+
+	if t.native {
+		rows, err := t.pool.Query(ctx, query, args...)
+		if err != nil {
+			return result, err
+		}
+		return pgx.CollectOneRow(rows, pgx.RowToStructByName[T])
+	}
+	if t.prepared {
+		stmt, err := t.stmt(query)
+		if err != nil {
+			return result, err
+		}
+		err = stmt.GetContext(ctx, &result, args...)
+		return result, err
+	}
+	err = t.db.GetContext(ctx, &result, query, args...)
+	return result, err
+}
+
+func queryAll[T any](t *target, query string, args ...any) (result []T, err error) {
+	result = []T{}
+	query = t.db.Rebind(query)
+	ctx, span := t.startQuery(query)
+	defer func() { endSpan(span, err) }()
+
+	if t.native {
+		rows, err := t.pool.Query(ctx, query, args...)
+		if err != nil {
+			return result, err
+		}
+		return pgx.CollectRows(rows, pgx.RowToStructByName[T])
+	}
+	if t.prepared {
+		stmt, err := t.stmt(query)
+		if err != nil {
+			return result, err
+		}
+		err = stmt.SelectContext(ctx, &result, args...)
+		return result, err
+	}
+	err = t.db.SelectContext(ctx, &result, query, args...)
+	return result, err
+}
+
+func (t *target) exec(query string, args ...any) (err error) {
+	query = t.db.Rebind(query)
+	ctx, span := t.startQuery(query)
+	defer func() { endSpan(span, err) }()
+
+	if t.native {
+		_, err := t.pool.Exec(ctx, query, args...)
+		return err
+	}
+	if t.prepared {
+		stmt, err := t.stmt(query)
+		if err != nil {
+			return err
+		}
+		_, err = stmt.ExecContext(ctx, args...)
+		return err
+	}
+	_, err = t.db.ExecContext(ctx, query, args...)
+	return err
+}
+
+// A workload is a single access pattern we measure against the seeded
+// products & product_reviews tables. Queries are written with `?` placeholders
+// and rebound for the driver, so the same workloads run on SQLite and Postgres.
+type workload struct {
+	name string
+
+	// Runs the i-th measured operation.
+	run func(t *target, i int) error
+
+	// Optional. Draws the arguments of the i-th operation, which run reads
+	// from target.args. They're drawn once per operation, so retries and
+	// explain get the same ones as the measured call.
+	args func(t *target, i int) []any
+
+	// Optional. Returns the server-side time of an operation with the given
+	// arguments, used when server timing is sampled. Only makes sense for
+	// single statement workloads.
+	explain func(t *target, args []any) (time.Duration, error)
+
+	// Optional. How many operations to measure, defaults to the Queries option.
+	iterations int
+
+	// Optional. Rows written by each operation, used to report rows/sec.
+	rows int
+
+	// Optional. Logical queries sent by each operation, used to report
+	// the latency per query of batched & pipelined workloads.
+	queries int
+
+	// Optional. Whether the workload picks products with the key
+	// distribution, through target.randomProductName.
+	keyed bool
+}
+
+// Number of products fetched together with their reviews by the
+// N+1, JOIN and batched workloads.
+const fetchProductCount = 10
+
+var workloads = []workload{
+	{name: "Read1", run: read1, explain: explainRead1},
+	{name: "Read2", run: read2, args: read2Args, explain: explainRead2, keyed: true},
+	{name: "Write1", run: write1, args: write1Args, explain: explainWrite1},
+	{name: "NPlusOne", run: reviewsNPlusOne},
+	{name: "Join", run: reviewsJoin},
+	{name: "Batched", run: reviewsBatched},
+}
+
+// Runs every workload against the given target.
+// The bulk workloads go last, as they add lots of products.
+func runWorkloads(t *target, opts SimulationOptions) ([]WorkloadResult, error) {
+	results, err := measureWorkloads(t, workloads, "", opts)
+	if err != nil {
+		return results, err
+	}
+
+	cacheResults, err := measureWorkloads(t, append(localCacheWorkloads(t), cacheAsideWorkloads(t, opts)...), "", opts)
+	results = append(results, cacheResults...)
+	if err != nil {
+		return results, err
+	}
+
+	// the pipelines and COPY always go through pgxpool, so they're measured
+	// once per scenario, under the label of its first client
+	if !opts.skipPoolWorkloads {
+		pgxResults, err := measureWorkloads(t, append(pipelineWorkloads(t), copyWorkloads(t)...), "", opts)
+		results = append(results, pgxResults...)
+		if err != nil {
+			return results, err
+		}
+	}
+
+	if opts.QueryModes {
+		modeResults, err := runQueryModes(t, opts)
+		results = append(results, modeResults...)
+		if err != nil {
+			return results, err
+		}
+	}
+
+	others := append(transactionWorkloads(t, opts), bulkWorkloads()...)
+	otherResults, err := measureWorkloads(t, others, "", opts)
+	return append(results, otherResults...), err
+}
+
+// Measures the workloads one after the other. The suffix is appended to
+// the workload names, to tell apart runs of the same workload.
+func measureWorkloads(t *target, ws []workload, suffix string, opts SimulationOptions) ([]WorkloadResult, error) {
+	results := []WorkloadResult{}
+	for _, w := range ws {
+		if opts.onlyWorkloads != nil && !opts.onlyWorkloads[w.name] && !opts.onlyWorkloads[w.name+suffix] {
+			continue
+		}
+		stats, err := measureWorkload(t, w, opts)
+		if err != nil {
+			return results, fmt.Errorf("%s%s: %w", w.name, suffix, err)
+		}
+		result := WorkloadResult{Name: w.name + suffix, Stats: stats}
+		if w.keyed {
+			result.KeyDistribution = opts.keyDistribution(w.name)
+		}
+		results = append(results, result)
+	}
+	return results, nil
+}
+
+func measureWorkload(t *target, w workload, opts SimulationOptions) (stats LatencyStats, err error) {
+	// the queries of the workload are traced in its span, see tracing.go
+	scenarioCtx := t.ctx
+	ctx, span := startSpan(t.context(), "workload "+w.name, workloadAttribute.String(w.name))
+	t.ctx, t.workload = ctx, w.name
+	defer func() {
+		t.ctx, t.workload = scenarioCtx, ""
+		endSpan(span, err)
+	}()
+
+	sampleServerTime := opts.ServerTiming && w.explain != nil && isPostgres(t.db)
+
+	t.rng = newRand(opts.Seed, w.name)
+	t.pickKey, t.args, t.retries = nil, nil, 0
+	t.cacheHits, t.cacheMisses = 0, 0
+	if w.keyed {
+		t.pickKey = newKeyPicker(opts.keyDistribution(w.name), t.products, opts, t.rng)
+	}
+
+	iterations := w.iterations
+	if iterations <= 0 {
+		iterations = opts.Queries
+	}
+
+	latencies := []time.Duration{}
+	serverTimes := []time.Duration{}
+	retries := 0
+	var total time.Duration
+	for i := 0; i < iterations; i++ {
+		// the latency includes retries, as that's what the caller would wait for
+		if w.args != nil {
+			t.args = w.args(t, i)
+		}
+		start := time.Now()
+		err := w.run(t, i)
+		for attempt := 0; attempt < maxRetries && isSerializationFailure(err); attempt++ {
+			retries++
+			err = w.run(t, i)
+		}
+		if err != nil {
+			return LatencyStats{}, err
+		}
+		latency := time.Since(start)
+		latencies = append(latencies, latency)
+		total += latency
+
+		if sampleServerTime {
+			serverTime, err := w.explain(t, t.args)
+			if err != nil {
+				return LatencyStats{}, err
+			}
+			serverTimes = append(serverTimes, serverTime)
+		}
+	}
+
+	stats, err = calculateLatencyStatsNs(latencies)
+	if err != nil {
+		return stats, err
+	}
+	stats.Retries = float64(retries + t.retries)
+	stats.CacheHits, stats.CacheMisses = float64(t.cacheHits), float64(t.cacheMisses)
+	if w.rows > 0 && total > 0 {
+		stats.RowsPerSecond = float64(w.rows*iterations) / total.Seconds()
+	}
+	if w.queries > 0 {
+		stats.PerQueryLatency = stats.MedianLatency / float64(w.queries)
+	}
+	return addServerLatency(stats, serverTimes)
+}
+
+// Reports whether the db is Postgres, through lib/pq or pgx's stdlib driver.
+func isPostgres(db *sqlx.DB) bool {
+	return db.DriverName() == "postgres" || db.DriverName() == "pgx"
+}
+
+const (
+	read1Query  = `SELECT id, name, price FROM products ORDER BY price DESC LIMIT 1`
+	read2Query  = `SELECT id, name, price FROM products WHERE name = ? LIMIT 1`
+	write1Query = `INSERT INTO products (name, price) VALUES (?, ?)`
+)
+
+// Gets the most expensive product.
+func read1(t *target, i int) error {
+	_, err := queryOne[product](t, read1Query)
+	return err
+}
+
+func explainRead1(t *target, args []any) (time.Duration, error) {
+	return explainAnalyze(t.db, read1Query)
+}
+
+// Gets a random product by name.
+func read2(t *target, i int) error {
+	_, err := queryOne[product](t, read2Query, t.args...)
+	return err
+}
+
+func read2Args(t *target, i int) []any {
+	return []any{t.randomProductName()}
+}
+
+func explainRead2(t *target, args []any) (time.Duration, error) {
+	return explainAnalyze(t.db, t.db.Rebind(read2Query), args...)
+}
+
+// Adds a new product.
+func write1(t *target, i int) error {
+	return t.exec(write1Query, t.args...)
+}
+
+func write1Args(t *target, i int) []any {
+	return []any{fmt.Sprintf("product%d", i), t.rng.Float64() * 100}
+}
+
+func explainWrite1(t *target, args []any) (time.Duration, error) {
+	// EXPLAIN ANALYZE actually runs the insert, so we roll it back
+	// to keep the row count the same as without server timing
+	tx, err := t.db.Beginx()
+	if err != nil {
+		return 0, err
+	}
+	defer tx.Rollback()
+	return explainAnalyze(tx, tx.Rebind(write1Query), args...)
+}
+
+type product struct {
+	ID    int     `db:"id"`
+	Name  string  `db:"name"`
+	Price float64 `db:"price"`
+}
+
+type productReview struct {
+	ProductID int    `db:"product_id"`
+	Review    string `db:"review"`
+}
+
+type productWithReview struct {
+	product
+	Review string `db:"review"`
+}
+
+// Picks the name of a product with the workload's key distribution.
+func (t *target) randomProductName() string {
+	if t.pickKey == nil {
+		return fmt.Sprintf("product%d", t.rng.Intn(t.products))
+	}
+	return fmt.Sprintf("product%d", t.pickKey())
+}
+
+// Picks a random range of fetchProductCount consecutive product ids.
+// Returns the first id and the id right after the last one.
+func randomProductRange(t *target) (int, int) {
+	from := 1 + t.rng.Intn(t.products-fetchProductCount+1)
+	return from, from + fetchProductCount
+}
+
+// Gets a random range of fetchProductCount products, see randomProductRange.
+func productsInRange(t *target) ([]product, error) {
+	from, to := randomProductRange(t)
+	return queryAll[product](t, `SELECT id, name, price FROM products WHERE id >= ? AND id < ? ORDER BY id`, from, to)
+}
+
+// Gets the products in the range, then runs one query per product for its
+// reviews. That's 1 + fetchProductCount round trips.
+func reviewsNPlusOne(t *target, i int) error {
+	products, err := productsInRange(t)
+	if err != nil {
+		return err
+	}
+
+	for _, p := range products {
+		_, err = queryAll[productReview](t, `SELECT product_id, review FROM product_reviews WHERE product_id = ?`, p.ID)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Gets the products in the range together with their reviews in one query.
+func reviewsJoin(t *target, i int) error {
+	from, to := randomProductRange(t)
+	_, err := queryAll[productWithReview](t, `
+		SELECT p.id, p.name, p.price, r.review
+		FROM products p
+		JOIN product_reviews r ON r.product_id = p.id
+		WHERE p.id >= ? AND p.id < ?
+		ORDER BY p.id`, from, to)
+	return err
+}
+
+// Gets the products in the range, then all of their reviews in a second
+// query with `WHERE product_id IN (...)`. That's always 2 round trips.
+func reviewsBatched(t *target, i int) error {
+	products, err := productsInRange(t)
+	if err != nil {
+		return err
+	}
+	if len(products) == 0 {
+		return nil
+	}
+	productIDs := make([]int, len(products))
+	for j, p := range products {
+		productIDs[j] = p.ID
+	}
+
+	query, args, err := sqlx.In(`SELECT product_id, review FROM product_reviews WHERE product_id IN (?)`, productIDs)
+	if err != nil {
+		return err
+	}
+	_, err = queryAll[productReview](t, query, args...)
+	return err
+}
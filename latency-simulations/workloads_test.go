@@ -0,0 +1,86 @@
+package latency_simulations
+
+import (
+	"context"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/jackc/pgx/v5/pgxpool"
+	"github.com/jmoiron/sqlx"
+)
+
+// Opens an empty SQLite db in a temporary directory.
+func openTestSQLite(t *testing.T) *sqlx.DB {
+	t.Helper()
+	db, err := sqlx.Open("sqlite3", filepath.Join(t.TempDir(), "workloads.sqlite")+"?_journal_mode=WAL&_busy_timeout=5000")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { db.Close() })
+	return db
+}
+
+// Opens a SQLite db in a temporary directory, with the tables of the
+// workloads seeded for the options.
+func openSeededSQLite(t *testing.T, opts SimulationOptions) *sqlx.DB {
+	t.Helper()
+	db := openTestSQLite(t)
+	err := createSQLiteTables(db)
+	if err == nil {
+		err = seed(db, opts)
+	}
+	if err != nil {
+		t.Fatal(err)
+	}
+	return db
+}
+
+// Returns valid options for a small dataset.
+func testSimulationOptions(t *testing.T) SimulationOptions {
+	t.Helper()
+	opts := newSimulationOptions()
+	opts.Seed = 1
+	opts.Products = minProductCount
+	opts.Queries = 20
+	opts.setDefaults()
+	err := opts.validate()
+	if err != nil {
+		t.Fatal(err)
+	}
+	return opts
+}
+
+// Every client runs the transaction and bulk workloads, pgxpool included,
+// and the pgxpool ones are only skipped for the other clients of a scenario.
+func TestRunWorkloadsDispatch(t *testing.T) {
+	opts := testSimulationOptions(t)
+	opts.onlyWorkloads = map[string]bool{"TxDeferred": true, "BulkValues10": true, "Pipeline10": true}
+
+	// the pool connects lazily, so its workloads only fail once they run
+	pool, err := pgxpool.New(context.Background(), "postgres://localhost:1/nothing?connect_timeout=1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer pool.Close()
+	tg := &target{db: openSeededSQLite(t, opts), pool: pool, native: true, products: opts.Products, ctx: context.Background()}
+
+	opts.skipPoolWorkloads = true
+	results, err := runWorkloads(tg, opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	names := []string{}
+	for _, r := range results {
+		names = append(names, r.Name)
+	}
+	if strings.Join(names, ",") != "TxDeferred,BulkValues10" {
+		t.Errorf("workloads = %v, want TxDeferred and BulkValues10", names)
+	}
+
+	opts.skipPoolWorkloads = false
+	_, err = runWorkloads(tg, opts)
+	if err == nil || !strings.HasPrefix(err.Error(), "Pipeline10") {
+		t.Errorf("runWorkloads() = %v, want the pool workloads to run", err)
+	}
+}
@@ -1,7 +1,10 @@
 package main
 
 import (
+	"context"
+	"go-on-rails/common"
 	latency_simulations "go-on-rails/latency-simulations"
+	"go-on-rails/users"
 	"log"
 
 	"github.com/gofiber/fiber/v2"
@@ -15,14 +18,39 @@ import (
 
 func main() {
 	log.Println("Starting server on port 3000")
+	shutdownTracing, err := common.StartTracing("go-on-rails")
+	if err != nil {
+		log.Fatalf("Error starting tracing: %v", err)
+	}
+	defer shutdownTracing(context.Background())
+
 	app := fiber.New()
 	app.Use(logger.New())
+	app.Use(common.Metrics)
 
 	// routes
 	app.Static("/", "./public")
+	users.AddRoutes(app)
+	common.AddMailerRoutes(app, users.RequireRole(users.Admin))
+	common.AddQueueRoutes(app, users.RequireRole(users.Admin))
+	common.AddMetricsRoutes(app)
 	latency_simulations.AddRoutes(app)
 
-	err := app.Listen(":3000")
+	// background jobs
+	err = common.StartMailer()
+	if err != nil {
+		log.Fatalf("Error starting the mailer: %v", err)
+	}
+	err = latency_simulations.StartWorkers()
+	if err != nil {
+		log.Fatalf("Error starting the simulation workers: %v", err)
+	}
+	err = latency_simulations.StartScheduler()
+	if err != nil {
+		log.Fatalf("Error starting the scheduler: %v", err)
+	}
+
+	err = app.Listen(":3000")
 	if err != nil {
 		log.Println("Error starting server")
 		log.Println(err)
@@ -0,0 +1,56 @@
+package users
+
+import "github.com/jmoiron/sqlx"
+
+var db *sqlx.DB
+
+// The sessions store opens the same file, see sessions.go.
+const databaseFile = "./db/users.sqlite?_journal_mode=WAL&_synchronous=NORMAL&_busy_timeout=5000&_cache_size=-2000"
+
+func initDB() error {
+	var err error
+	db, err = sqlx.Open("sqlite3", databaseFile)
+	if err != nil {
+		return err
+	}
+	_, err = db.Exec("PRAGMA foreign_keys = ON")
+	if err != nil {
+		return err
+	}
+	_, err = db.Exec("PRAGMA journal_mode = WAL")
+	if err != nil {
+		return err
+	}
+	_, err = db.Exec("PRAGMA synchronous = NORMAL")
+	if err != nil {
+		return err
+	}
+	_, err = db.Exec("PRAGMA busy_timeout = 5000")
+	if err != nil {
+		return err
+	}
+
+	_, err = db.Exec(`CREATE TABLE IF NOT EXISTS users (
+		id INTEGER PRIMARY KEY AUTOINCREMENT,
+		username TEXT NOT NULL UNIQUE,
+		password_hash TEXT NOT NULL,
+		role TEXT NOT NULL,
+		created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
+		updated_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP
+	)`)
+	if err != nil {
+		return err
+	}
+
+	// sessions used to be stored in a table of our own, which the sessions
+	// store can't use, so it's dropped (logging everyone out once)
+	var legacySessions bool
+	err = db.Get(&legacySessions, `SELECT COUNT(*) > 0 FROM pragma_table_info('sessions') WHERE name = 'expires_at'`)
+	if err != nil {
+		return err
+	}
+	if legacySessions {
+		_, err = db.Exec(`DROP TABLE sessions`)
+	}
+	return err
+}
@@ -0,0 +1,191 @@
+package users
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+	"go-on-rails/common"
+	"log"
+	"time"
+
+	"github.com/jmoiron/sqlx"
+	_ "github.com/mattn/go-sqlite3"
+	"golang.org/x/crypto/bcrypt"
+)
+
+func init() {
+	err := initDB()
+	if err != nil {
+		panic(err)
+	}
+	sessions = newSessionStore()
+	err = bootstrapAdmin()
+	if err != nil {
+		panic(err)
+	}
+}
+
+// Roles are ordered, every role can do what the roles before it can:
+//
+// - viewer: views results (which are public unless PUBLIC_RESULTS is false)
+//
+// - runner: also triggers simulation runs
+//
+// - admin: also edits scenarios and manages users
+type Role string
+
+const (
+	Viewer Role = "viewer"
+	Runner Role = "runner"
+	Admin  Role = "admin"
+)
+
+var Roles = []Role{Viewer, Runner, Admin}
+
+func (r Role) level() int {
+	for i, role := range Roles {
+		if r == role {
+			return i
+		}
+	}
+	return -1
+}
+
+// Whether the role can do what the given role can.
+func (r Role) Includes(role Role) bool {
+	return r.level() >= role.level() && role.level() >= 0
+}
+
+func parseRole(s string) (Role, error) {
+	role := Role(s)
+	if role.level() < 0 {
+		return "", fmt.Errorf("unknown role %q", s)
+	}
+	return role, nil
+}
+
+type User struct {
+	ID           int       `db:"id"`
+	Username     string    `db:"username"`
+	PasswordHash string    `db:"password_hash"`
+	Role         Role      `db:"role"`
+	CreatedAt    time.Time `db:"created_at"`
+	UpdatedAt    time.Time `db:"updated_at"`
+}
+
+// Whether the user can do what the given role can.
+func (u *User) Can(role Role) bool {
+	return u != nil && u.Role.Includes(role)
+}
+
+func createUser(username string, password string, role Role) error {
+	if username == "" || len(password) < 8 {
+		return fmt.Errorf("a username and a password of at least 8 characters are required")
+	}
+	hash, err := bcrypt.GenerateFromPassword([]byte(password), bcrypt.DefaultCost)
+	if err != nil {
+		return err
+	}
+	_, err = db.Exec(`INSERT INTO users (username, password_hash, role) VALUES (?, ?, ?)`, username, string(hash), role)
+	return err
+}
+
+// Returns the user with the given credentials, or nil if they're wrong.
+func authenticate(username string, password string) (*User, error) {
+	user, err := getUser(`SELECT * FROM users WHERE username = ?`, username)
+	if err != nil || user == nil {
+		return nil, err
+	}
+	err = bcrypt.CompareHashAndPassword([]byte(user.PasswordHash), []byte(password))
+	if err == bcrypt.ErrMismatchedHashAndPassword {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	return user, nil
+}
+
+func userByID(id int) (*User, error) {
+	return getUser(`SELECT * FROM users WHERE id = ?`, id)
+}
+
+func getUser(query string, args ...any) (*User, error) {
+	var user User
+	err := db.Get(&user, query, args...)
+	if err == sql.ErrNoRows {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	return &user, nil
+}
+
+func listUsers() ([]User, error) {
+	users := []User{}
+	err := db.Select(&users, `SELECT * FROM users ORDER BY username`)
+	return users, err
+}
+
+var errLastAdmin = errors.New("the last admin can't be demoted or deleted")
+
+func updateRole(id int, role Role) error {
+	return withAdminsKept(id, role == Admin, func(tx *sqlx.Tx) error {
+		_, err := tx.Exec(`UPDATE users SET role = ?, updated_at = CURRENT_TIMESTAMP WHERE id = ?`, role, id)
+		return err
+	})
+}
+
+func deleteUser(id int) error {
+	return withAdminsKept(id, false, func(tx *sqlx.Tx) error {
+		_, err := tx.Exec(`DELETE FROM users WHERE id = ?`, id)
+		return err
+	})
+}
+
+// Runs a change of the user in a transaction, unless the user is the last
+// admin and stays one, so there's always someone left to manage users.
+// The transaction starts as a write, so admins can't be changed in between.
+func withAdminsKept(id int, staysAdmin bool, change func(tx *sqlx.Tx) error) error {
+	tx, err := db.Beginx()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	// a no-op write takes SQLite's write lock before the count is read
+	_, err = tx.Exec(`UPDATE users SET id = id WHERE id = ?`, id)
+	if err != nil {
+		return err
+	}
+	var lastAdmin bool
+	err = tx.Get(&lastAdmin, `SELECT role = ? AND (SELECT COUNT(*) FROM users WHERE role = ?) = 1 FROM users WHERE id = ?`, Admin, Admin, id)
+	if err != nil && err != sql.ErrNoRows {
+		return err
+	}
+	if lastAdmin && !staysAdmin {
+		return errLastAdmin
+	}
+
+	err = change(tx)
+	if err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+// Creates an admin from ADMIN_USERNAME & ADMIN_PASSWORD when there are no
+// users yet, so a fresh instance can be logged into.
+func bootstrapAdmin() error {
+	if common.Env.ADMIN_PASSWORD == "" {
+		return nil
+	}
+	var count int
+	err := db.Get(&count, `SELECT COUNT(*) FROM users`)
+	if err != nil || count > 0 {
+		return err
+	}
+	log.Printf("Creating admin user %s", common.Env.ADMIN_USERNAME)
+	return createUser(common.Env.ADMIN_USERNAME, common.Env.ADMIN_PASSWORD, Admin)
+}
@@ -0,0 +1,45 @@
+package users
+
+import (
+	"errors"
+	"sync"
+	"time"
+)
+
+// Every password check runs bcrypt, which is slow on purpose, and API clients
+// send their password with every request. Password checks are capped per
+// client IP so they can't be used to guess passwords or to load the server.
+const (
+	passwordChecksPerWindow = 30
+	passwordCheckWindow     = time.Minute
+)
+
+var errTooManyPasswordChecks = errors.New("too many login attempts, try again in a minute")
+
+var passwordChecks = newRateLimiter(passwordChecksPerWindow, passwordCheckWindow)
+
+// Counts the calls of each key in fixed windows of time.
+type rateLimiter struct {
+	mu        sync.Mutex
+	limit     int
+	window    time.Duration
+	windowEnd time.Time
+	counts    map[string]int
+}
+
+func newRateLimiter(limit int, window time.Duration) *rateLimiter {
+	return &rateLimiter{limit: limit, window: window, counts: map[string]int{}}
+}
+
+// Counts a call of the key and reports whether it's within the limit.
+func (l *rateLimiter) allow(key string) bool {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	now := time.Now()
+	if now.After(l.windowEnd) {
+		l.counts = map[string]int{}
+		l.windowEnd = now.Add(l.window)
+	}
+	l.counts[key]++
+	return l.counts[key] <= l.limit
+}
@@ -0,0 +1,103 @@
+package users
+
+import (
+	"errors"
+	"go-on-rails/common"
+
+	"github.com/a-h/templ"
+	"github.com/gofiber/fiber/v2"
+)
+
+func AddRoutes(app *fiber.App) {
+	app.Get("/login", common.CSRF, func(c *fiber.Ctx) error {
+		return common.RenderTempl(c, login_page("", common.CSRFToken(c)))
+	})
+
+	app.Post("/login", common.CSRF, func(c *fiber.Ctx) error {
+		user, err := authenticateRequest(c, c.FormValue("username"), c.FormValue("password"))
+		if errors.Is(err, errTooManyPasswordChecks) {
+			return common.RenderTempl(c, login_page(err.Error(), common.CSRFToken(c)), templ.WithStatus(fiber.StatusTooManyRequests))
+		}
+		if err != nil {
+			return c.Status(500).SendString(err.Error())
+		}
+		if user == nil {
+			return common.RenderTempl(c, login_page("Wrong username or password", common.CSRFToken(c)))
+		}
+
+		err = logIn(c, user)
+		if err != nil {
+			return c.Status(500).SendString(err.Error())
+		}
+		return c.Redirect("/")
+	})
+
+	app.Post("/logout", common.CSRF, func(c *fiber.Ctx) error {
+		err := logOut(c)
+		if err != nil {
+			return c.Status(500).SendString(err.Error())
+		}
+		return c.Redirect("/")
+	})
+
+	admin := app.Group("/users", RequireRole(Admin), common.CSRF)
+
+	admin.Get("/", func(c *fiber.Ctx) error {
+		users, err := listUsers()
+		if err != nil {
+			return c.Status(500).SendString(err.Error())
+		}
+		c.Set("Cache-Control", "no-store")
+		return common.RenderTempl(c, users_page(users, Roles, common.CSRFToken(c)))
+	})
+
+	admin.Post("/", func(c *fiber.Ctx) error {
+		role, err := parseRole(c.FormValue("role"))
+		if err != nil {
+			return c.Status(400).SendString(err.Error())
+		}
+		err = createUser(c.FormValue("username"), c.FormValue("password"), role)
+		if err != nil {
+			return c.Status(400).SendString(err.Error())
+		}
+		return c.Redirect("/users")
+	})
+
+	admin.Post("/:id/role", func(c *fiber.Ctx) error {
+		id, err := c.ParamsInt("id")
+		if err != nil {
+			return c.Status(400).SendString(err.Error())
+		}
+		role, err := parseRole(c.FormValue("role"))
+		if err != nil {
+			return c.Status(400).SendString(err.Error())
+		}
+		err = updateRole(id, role)
+		if errors.Is(err, errLastAdmin) {
+			return c.Status(400).SendString(err.Error())
+		}
+		if err != nil {
+			return c.Status(500).SendString(err.Error())
+		}
+		return c.Redirect("/users")
+	})
+
+	admin.Post("/:id/delete", func(c *fiber.Ctx) error {
+		id, err := c.ParamsInt("id")
+		if err != nil {
+			return c.Status(400).SendString(err.Error())
+		}
+		user, _ := CurrentUser(c)
+		if user.ID == id {
+			return c.Status(400).SendString("You can't delete yourself")
+		}
+		err = deleteUser(id)
+		if errors.Is(err, errLastAdmin) {
+			return c.Status(400).SendString(err.Error())
+		}
+		if err != nil {
+			return c.Status(500).SendString(err.Error())
+		}
+		return c.Redirect("/users")
+	})
+}
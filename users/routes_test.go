@@ -0,0 +1,222 @@
+package users
+
+import (
+	"errors"
+	"go-on-rails/common"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gofiber/fiber/v2"
+)
+
+// The tests run against ./db/users.sqlite, see make test. They start from
+// the admin bootstrapped from ADMIN_USERNAME & ADMIN_PASSWORD only.
+func TestMain(m *testing.M) {
+	_, err := db.Exec(`DELETE FROM users`)
+	if err == nil {
+		err = bootstrapAdmin()
+	}
+	if err != nil {
+		panic(err)
+	}
+	os.Exit(m.Run())
+}
+
+const testPassword = "password123"
+
+// A browser of the test app, keeping the cookies it's sent.
+type testClient struct {
+	t       *testing.T
+	app     *fiber.App
+	cookies map[string]*http.Cookie
+}
+
+// Returns a client of an app with the users routes and a route for runners,
+// with a fresh limit of password checks.
+func newTestClient(t *testing.T) *testClient {
+	passwordChecks = newRateLimiter(passwordChecksPerWindow, passwordCheckWindow)
+	app := fiber.New()
+	AddRoutes(app)
+	app.Post("/runs", RequireRole(Runner), common.CSRF, func(c *fiber.Ctx) error {
+		return c.SendString("started")
+	})
+	return &testClient{t: t, app: app, cookies: map[string]*http.Cookie{}}
+}
+
+// Sends a request with the cookies and, if set, basic auth credentials.
+func (c *testClient) do(method string, path string, form url.Values, credentials ...string) *http.Response {
+	c.t.Helper()
+	req := httptest.NewRequest(method, path, strings.NewReader(form.Encode()))
+	if form != nil {
+		req.Header.Set(fiber.HeaderContentType, fiber.MIMEApplicationForm)
+	}
+	if len(credentials) == 2 {
+		req.SetBasicAuth(credentials[0], credentials[1])
+	}
+	for _, cookie := range c.cookies {
+		req.AddCookie(cookie)
+	}
+	res, err := c.app.Test(req, -1)
+	if err != nil {
+		c.t.Fatal(err)
+	}
+	for _, cookie := range res.Cookies() {
+		c.cookies[cookie.Name] = cookie
+	}
+	return res
+}
+
+// Posts a form with the CSRF token of the login page.
+func (c *testClient) post(path string, form url.Values) *http.Response {
+	c.t.Helper()
+	if c.cookies["csrf_"] == nil {
+		c.do("GET", "/login", nil)
+	}
+	form.Set("_csrf", c.cookies["csrf_"].Value)
+	return c.do("POST", path, form)
+}
+
+func (c *testClient) logIn(username string, password string) *http.Response {
+	c.t.Helper()
+	return c.post("/login", url.Values{"username": {username}, "password": {password}})
+}
+
+func createTestUser(t *testing.T, username string, role Role) *User {
+	t.Helper()
+	err := createUser(username, testPassword, role)
+	if err != nil {
+		t.Fatal(err)
+	}
+	user, err := getUser(`SELECT * FROM users WHERE username = ?`, username)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return user
+}
+
+func TestLogin(t *testing.T) {
+	c := newTestClient(t)
+
+	res := c.logIn(common.Env.ADMIN_USERNAME, "wrong password")
+	if res.StatusCode != 200 {
+		t.Errorf("login with a wrong password = %d, want the login page", res.StatusCode)
+	}
+	if res := c.do("GET", "/users", nil); res.StatusCode != 302 || res.Header.Get("Location") != "/login" {
+		t.Errorf("GET /users after a failed login = %d to %q, want a redirect to /login", res.StatusCode, res.Header.Get("Location"))
+	}
+
+	res = c.logIn(common.Env.ADMIN_USERNAME, common.Env.ADMIN_PASSWORD)
+	if res.StatusCode != 302 {
+		t.Fatalf("login = %d, want a redirect", res.StatusCode)
+	}
+	session := c.cookies["session_id"]
+	if session == nil || !session.Secure || !session.HttpOnly {
+		t.Errorf("session cookie = %+v, want it secure and HTTP only", session)
+	}
+	if res := c.do("GET", "/users", nil); res.StatusCode != 200 {
+		t.Errorf("GET /users after logging in = %d, want 200", res.StatusCode)
+	}
+
+	c.post("/logout", url.Values{})
+	if res := c.do("GET", "/users", nil); res.StatusCode != 302 {
+		t.Errorf("GET /users after logging out = %d, want a redirect", res.StatusCode)
+	}
+}
+
+func TestRoles(t *testing.T) {
+	createTestUser(t, "roles-viewer", Viewer)
+	createTestUser(t, "roles-runner", Runner)
+	c := newTestClient(t)
+
+	if res := c.do("POST", "/runs", nil); res.StatusCode != 401 {
+		t.Errorf("anonymous POST /runs = %d, want 401", res.StatusCode)
+	}
+	for _, tt := range []struct {
+		username string
+		password string
+		users    int
+		runs     int
+	}{
+		{"roles-viewer", testPassword, 403, 403},
+		{"roles-runner", testPassword, 403, 200},
+		{common.Env.ADMIN_USERNAME, common.Env.ADMIN_PASSWORD, 200, 200},
+		{"roles-runner", "wrong password", 302, 401},
+	} {
+		// basic auth skips the CSRF check of POST /runs
+		if res := c.do("GET", "/users", nil, tt.username, tt.password); res.StatusCode != tt.users {
+			t.Errorf("GET /users as %s = %d, want %d", tt.username, res.StatusCode, tt.users)
+		}
+		if res := c.do("POST", "/runs", nil, tt.username, tt.password); res.StatusCode != tt.runs {
+			t.Errorf("POST /runs as %s = %d, want %d", tt.username, res.StatusCode, tt.runs)
+		}
+	}
+}
+
+func TestCSRF(t *testing.T) {
+	createTestUser(t, "csrf-runner", Runner)
+	c := newTestClient(t)
+	c.logIn("csrf-runner", testPassword)
+
+	if res := c.do("POST", "/runs", url.Values{}); res.StatusCode != 403 {
+		t.Errorf("POST /runs without a CSRF token = %d, want 403", res.StatusCode)
+	}
+	if res := c.do("POST", "/runs", url.Values{"_csrf": {"forged"}}); res.StatusCode != 403 {
+		t.Errorf("POST /runs with a forged CSRF token = %d, want 403", res.StatusCode)
+	}
+	if res := c.post("/runs", url.Values{}); res.StatusCode != 200 {
+		t.Errorf("POST /runs with the CSRF token = %d, want 200", res.StatusCode)
+	}
+}
+
+func TestLastAdmin(t *testing.T) {
+	admin, err := getUser(`SELECT * FROM users WHERE username = ?`, common.Env.ADMIN_USERNAME)
+	if err != nil {
+		t.Fatal(err)
+	}
+	c := newTestClient(t)
+	c.logIn(common.Env.ADMIN_USERNAME, common.Env.ADMIN_PASSWORD)
+
+	if res := c.post("/users/"+strconv.Itoa(admin.ID)+"/role", url.Values{"role": {"runner"}}); res.StatusCode != 400 {
+		t.Errorf("demoting the last admin = %d, want 400", res.StatusCode)
+	}
+	if err := deleteUser(admin.ID); !errors.Is(err, errLastAdmin) {
+		t.Errorf("deleteUser() of the last admin = %v, want errLastAdmin", err)
+	}
+
+	other := createTestUser(t, "last-admin-other", Admin)
+	if res := c.post("/users/"+strconv.Itoa(other.ID)+"/role", url.Values{"role": {"viewer"}}); res.StatusCode != 302 {
+		t.Errorf("demoting an admin that isn't the last one = %d, want a redirect", res.StatusCode)
+	}
+	if res := c.post("/users/"+strconv.Itoa(other.ID)+"/role", url.Values{"role": {"admin"}}); res.StatusCode != 302 {
+		t.Errorf("promoting a viewer = %d, want a redirect", res.StatusCode)
+	}
+	if res := c.post("/users/"+strconv.Itoa(other.ID)+"/delete", url.Values{}); res.StatusCode != 302 {
+		t.Errorf("deleting an admin that isn't the last one = %d, want a redirect", res.StatusCode)
+	}
+	if user, _ := userByID(admin.ID); !user.Can(Admin) {
+		t.Errorf("the last admin is now %+v", user)
+	}
+}
+
+func TestPasswordCheckLimit(t *testing.T) {
+	c := newTestClient(t)
+	passwordChecks = newRateLimiter(2, time.Minute)
+
+	for i := 0; i < 2; i++ {
+		if res := c.do("GET", "/users", nil, common.Env.ADMIN_USERNAME, common.Env.ADMIN_PASSWORD); res.StatusCode != 200 {
+			t.Fatalf("GET /users within the limit = %d, want 200", res.StatusCode)
+		}
+	}
+	if res := c.do("GET", "/users", nil, common.Env.ADMIN_USERNAME, common.Env.ADMIN_PASSWORD); res.StatusCode != 429 {
+		t.Errorf("GET /users over the limit = %d, want 429", res.StatusCode)
+	}
+	if res := c.logIn(common.Env.ADMIN_USERNAME, common.Env.ADMIN_PASSWORD); res.StatusCode != 429 {
+		t.Errorf("login over the limit = %d, want 429", res.StatusCode)
+	}
+}
@@ -0,0 +1,146 @@
+package users
+
+import (
+	"encoding/base64"
+	"errors"
+	"go-on-rails/common"
+	"strings"
+	"time"
+
+	"github.com/gofiber/fiber/v2"
+	"github.com/gofiber/fiber/v2/middleware/session"
+	"github.com/gofiber/storage/sqlite3"
+)
+
+// Sessions are stored in the users db file, in a sessions table managed by
+// gofiber/storage. The store is created once the db is set up (see init),
+// so it never sees the table sessions used to be stored in.
+var sessions *session.Store
+
+func newSessionStore() *session.Store {
+	return session.New(session.Config{
+		Storage:        sqlite3.New(sqlite3.Config{Database: databaseFile, Table: "sessions"}),
+		Expiration:     24 * time.Hour,
+		KeyLookup:      "cookie:session_id",
+		CookieHTTPOnly: true,
+		CookieSecure:   common.Env.SECURE_COOKIES == "true",
+		CookieSameSite: "Lax",
+	})
+}
+
+const sessionUserKey = "user_id"
+
+// Starts a new session for the user. The session id is regenerated so
+// a session id set before logging in can't be reused.
+func logIn(c *fiber.Ctx, user *User) error {
+	sess, err := sessions.Get(c)
+	if err != nil {
+		return err
+	}
+	err = sess.Regenerate()
+	if err != nil {
+		return err
+	}
+	sess.Set(sessionUserKey, user.ID)
+	return sess.Save()
+}
+
+func logOut(c *fiber.Ctx) error {
+	sess, err := sessions.Get(c)
+	if err != nil {
+		return err
+	}
+	return sess.Destroy()
+}
+
+const currentUserKey = "users.current_user"
+
+// Returns the logged in user, or nil for anonymous visitors. API clients
+// can authenticate each request with basic auth instead of a session.
+func CurrentUser(c *fiber.Ctx) (*User, error) {
+	if user, ok := c.Locals(currentUserKey).(*User); ok {
+		return user, nil
+	}
+
+	var user *User
+	if username, password, ok := basicAuth(c); ok {
+		var err error
+		user, err = authenticateRequest(c, username, password)
+		if err != nil {
+			return nil, err
+		}
+	} else {
+		sess, err := sessions.Get(c)
+		if err != nil {
+			return nil, err
+		}
+		if id, ok := sess.Get(sessionUserKey).(int); ok {
+			user, err = userByID(id)
+			if err != nil {
+				return nil, err
+			}
+		}
+	}
+
+	if user != nil {
+		c.Locals(currentUserKey, user)
+	}
+	return user, nil
+}
+
+// Authenticates a login or basic auth request, within the limit of password
+// checks of the client, see ratelimit.go.
+func authenticateRequest(c *fiber.Ctx, username string, password string) (*User, error) {
+	if !passwordChecks.allow(c.IP()) {
+		return nil, errTooManyPasswordChecks
+	}
+	return authenticate(username, password)
+}
+
+// Parses the credentials of a basic auth header.
+func basicAuth(c *fiber.Ctx) (string, string, bool) {
+	encoded, ok := strings.CutPrefix(c.Get(fiber.HeaderAuthorization), "Basic ")
+	if !ok {
+		return "", "", false
+	}
+	decoded, err := base64.StdEncoding.DecodeString(encoded)
+	if err != nil {
+		return "", "", false
+	}
+	return strings.Cut(string(decoded), ":")
+}
+
+// Only lets users with the given role (or a higher one) through. Anonymous
+// visitors are sent to the login page, or get a 401 for non-GET requests.
+//
+//	app.Post("/simulate", users.RequireRole(users.Runner), common.CSRF, handler)
+func RequireRole(role Role) fiber.Handler {
+	return func(c *fiber.Ctx) error {
+		user, err := CurrentUser(c)
+		if errors.Is(err, errTooManyPasswordChecks) {
+			return c.Status(fiber.StatusTooManyRequests).SendString(err.Error())
+		}
+		if err != nil {
+			return c.Status(500).SendString(err.Error())
+		}
+		if user == nil {
+			if c.Method() == fiber.MethodGet {
+				return c.Redirect("/login")
+			}
+			return c.Status(fiber.StatusUnauthorized).SendString("Log in to do this")
+		}
+		if !user.Can(role) {
+			return c.Status(fiber.StatusForbidden).SendString("Your role can't do this")
+		}
+		return c.Next()
+	}
+}
+
+// Guards pages showing results: they're public unless PUBLIC_RESULTS is
+// false, in which case they need the viewer role.
+var RequireViewer = func(c *fiber.Ctx) error {
+	if common.Env.PUBLIC_RESULTS == "true" {
+		return c.Next()
+	}
+	return RequireRole(Viewer)(c)
+}